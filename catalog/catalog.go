@@ -0,0 +1,409 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/busoc/panda"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	DefaultTimeout = time.Second
+	DefaultPending = 1 << 16
+)
+
+var ErrDone = errors.New("done")
+
+var products = []byte("products")
+
+type Location struct {
+	Scheme string `json:"scheme" xml:"scheme,attr"`
+	File   string `json:"file" xml:"file,attr"`
+	Member string `json:"member,omitempty" xml:"member,attr,omitempty"`
+}
+
+// Entry describes a product stored by hadock and the places where it can be
+// found. The channel is unknown (zero) for entries rebuilt from an archive.
+type Entry struct {
+	Instance  uint8         `json:"instance"`
+	Channel   panda.Channel `json:"channel"`
+	Type      string        `json:"type"`
+	Realtime  bool          `json:"realtime"`
+	Origin    string        `json:"origin"`
+	UPI       string        `json:"upi,omitempty"`
+	Sequence  uint32        `json:"sequence"`
+	Format    string        `json:"format"`
+	Size      int64         `json:"size"`
+	Valid     bool          `json:"valid"`
+	VMU       time.Time     `json:"vmu"`
+	ACQ       time.Time     `json:"acq"`
+	Locations []Location    `json:"locations"`
+}
+
+// Key gives the key of the entry in the catalog. Entries are sorted by
+// acquisition time first. The acquisition time is truncated to the second as
+// in the names of the files so that entries indexed when products are stored
+// and when an archive is indexed are merged.
+func (e Entry) Key() []byte {
+	k := timeKey(e.ACQ.Truncate(time.Second))
+	k = append(k, e.Instance)
+	if e.Realtime {
+		k = append(k, 1)
+	} else {
+		k = append(k, 0)
+	}
+	var seq [4]byte
+	binary.BigEndian.PutUint32(seq[:], e.Sequence)
+	k = append(k, seq[:]...)
+	return append(k, e.Origin...)
+}
+
+func (e Entry) merge(o Entry) Entry {
+	ls := e.Locations
+	for _, n := range o.Locations {
+		var found bool
+		for _, x := range ls {
+			if x == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ls = append(ls, n)
+		}
+	}
+	if o.Channel == 0 {
+		o.Channel = e.Channel
+	}
+	if o.UPI == "" {
+		o.UPI = e.UPI
+	}
+	// times of rebuilt entries are only known to the second
+	o.ACQ, o.VMU = precise(e.ACQ, o.ACQ), precise(e.VMU, o.VMU)
+	o.Locations = ls
+	return o
+}
+
+func precise(t, o time.Time) time.Time {
+	if o.Nanosecond() == 0 && t.Truncate(time.Second).Equal(o) {
+		return t
+	}
+	return o
+}
+
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 12)
+	binary.BigEndian.PutUint64(k, uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(k[8:], uint32(t.Nanosecond()))
+	return k
+}
+
+type Query struct {
+	Starts time.Time
+	Ends   time.Time
+	// Time selects the time (acq or vmu) compared to Starts and Ends
+	Time string
+
+	// Instance is ignored when negative
+	Instance int
+	Type     string
+	Mode     string
+	Origin   string
+	UPI      string
+	Format   string
+	Valid    *bool
+}
+
+func (q Query) byVMU() bool {
+	return strings.ToLower(q.Time) == "vmu"
+}
+
+func (q Query) Match(e Entry) bool {
+	t := e.ACQ
+	if q.byVMU() {
+		t = e.VMU
+	}
+	if (!q.Starts.IsZero() && t.Before(q.Starts)) || (!q.Ends.IsZero() && t.After(q.Ends)) {
+		return false
+	}
+	if q.Valid != nil && *q.Valid != e.Valid {
+		return false
+	}
+	if q.Instance >= 0 && uint8(q.Instance) != e.Instance {
+		return false
+	}
+	if q.Type != "" && !strings.EqualFold(q.Type, e.Type) {
+		return false
+	}
+	switch strings.ToLower(q.Mode) {
+	case "realtime":
+		if !e.Realtime {
+			return false
+		}
+	case "playback":
+		if e.Realtime {
+			return false
+		}
+	}
+	if q.Origin != "" && !strings.EqualFold(q.Origin, e.Origin) {
+		return false
+	}
+	if q.UPI != "" && q.UPI != e.UPI {
+		return false
+	}
+	if q.Format != "" && !strings.EqualFold(q.Format, e.Format) {
+		return false
+	}
+	return true
+}
+
+// Search calls fn for each entry of the catalog in file matching q by
+// acquisition time. When q selects the vmu time, the whole catalog is
+// scanned. Searching stops without error when fn returns ErrDone.
+func Search(file string, q Query, fn func(Entry) error) error {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: DefaultTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var ends []byte
+	if !q.Ends.IsZero() && !q.byVMU() {
+		ends = timeKey(q.Ends)
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(products)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+
+		var k, v []byte
+		if q.Starts.IsZero() || q.byVMU() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(timeKey(q.Starts.Truncate(time.Second)))
+		}
+		for ; k != nil; k, v = c.Next() {
+			if ends != nil && bytes.Compare(k[:len(ends)], ends) > 0 {
+				break
+			}
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !q.Match(e) {
+				continue
+			}
+			if err := fn(e); err != nil {
+				if err == ErrDone {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Collect gives the entries of the catalog in file matching q in the order of
+// their acquisition time. The same product can be found in realtime and
+// playback: only its first entry is kept. When max is set, collecting stops
+// once more than max entries are found.
+func Collect(file string, q Query, max int) ([]Entry, error) {
+	type key struct {
+		Origin   string
+		Sequence uint32
+		ACQ      int64
+	}
+	var (
+		es   []Entry
+		seen = make(map[key]bool)
+		last time.Time
+	)
+	err := Search(file, q, func(e Entry) error {
+		// entries are ordered by second: the ones of the previous seconds have
+		// all been found
+		if t := e.ACQ.Truncate(time.Second); !t.Equal(last) {
+			if max > 0 && len(es) > max {
+				return ErrDone
+			}
+			seen, last = make(map[key]bool), t
+		}
+		k := key{Origin: e.Origin, Sequence: e.Sequence, ACQ: e.ACQ.UnixNano()}
+		if seen[k] {
+			return nil
+		}
+		seen[k], es = true, append(es, e)
+		return nil
+	})
+	Sort(es)
+	return es, err
+}
+
+// Sort orders es by acquisition time. The catalog gives the entries of the
+// same second by instance, mode and sequence.
+func Sort(es []Entry) {
+	sort.SliceStable(es, func(i, j int) bool {
+		return es[i].ACQ.Before(es[j].ACQ)
+	})
+}
+
+// Remove removes the location l from the entry of the catalog in file with
+// the same key as e. The entry is deleted when it has no location left.
+func Remove(file string, e Entry, l Location) error {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: DefaultTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(products)
+		if b == nil {
+			return nil
+		}
+		k := e.Key()
+		bs := b.Get(k)
+		if bs == nil {
+			return nil
+		}
+		var o Entry
+		if err := json.Unmarshal(bs, &o); err != nil {
+			return err
+		}
+		ls := o.Locations[:0]
+		for _, x := range o.Locations {
+			if x != l {
+				ls = append(ls, x)
+			}
+		}
+		if len(ls) == 0 {
+			return b.Delete(k)
+		}
+		o.Locations = ls
+		if bs, err = json.Marshal(o); err != nil {
+			return err
+		}
+		return b.Put(k, bs)
+	})
+}
+
+// Catalog adds entries to the catalog in batches. The database is only kept
+// open while a batch is written so that other processes can search it.
+type Catalog struct {
+	file  string
+	queue chan Entry
+	done  chan struct{}
+}
+
+func Open(file string) (*Catalog, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: DefaultTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(products)
+		return err
+	})
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := Catalog{
+		file:  file,
+		queue: make(chan Entry, 1024),
+		done:  make(chan struct{}),
+	}
+	go c.run()
+	return &c, nil
+}
+
+func (c *Catalog) Add(e Entry) {
+	c.queue <- e
+}
+
+func (c *Catalog) Close() error {
+	close(c.queue)
+	<-c.done
+	return nil
+}
+
+func (c *Catalog) run() {
+	defer close(c.done)
+
+	logger := log.New(os.Stderr, "[catalog] ", 0)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	var es []Entry
+	for {
+		select {
+		case e, ok := <-c.queue:
+			if !ok {
+				if err := c.flush(es); err != nil {
+					logger.Printf("%d entries lost: %s", len(es), err)
+				}
+				return
+			}
+			es = append(es, e)
+		case <-tick.C:
+			if len(es) == 0 {
+				continue
+			}
+			if err := c.flush(es); err != nil {
+				logger.Println(err)
+				if len(es) < DefaultPending {
+					continue
+				}
+				logger.Printf("%d entries dropped", len(es))
+			}
+			es = es[:0]
+		}
+	}
+}
+
+func (c *Catalog) flush(es []Entry) error {
+	if len(es) == 0 {
+		return nil
+	}
+	db, err := bolt.Open(c.file, 0644, &bolt.Options{Timeout: DefaultTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(products)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			k := e.Key()
+			if bs := b.Get(k); bs != nil {
+				var o Entry
+				if err := json.Unmarshal(bs, &o); err == nil {
+					e = o.merge(e)
+				}
+			}
+			bs, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/busoc/hadock/catalog"
+	"github.com/busoc/hadock/storage"
+	"github.com/midbel/cli"
+	"github.com/midbel/toml"
+)
+
+type indexer struct {
+	*catalog.Catalog
+
+	count   int
+	skipped int
+}
+
+func runCatalog(cmd *cli.Command, args []string) error {
+	reset := cmd.Flag.Bool("r", false, "remove the existing catalog first")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	f, err := os.Open(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	c := struct {
+		Catalog string            `toml:"catalog"`
+		Stores  []storage.Options `toml:"storage"`
+	}{}
+	if err := toml.Decode(f, &c); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+	if c.Catalog == "" {
+		return fmt.Errorf("%s: no catalog defined", cmd.Flag.Arg(0))
+	}
+	if *reset {
+		if err := os.Remove(c.Catalog); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	cat, err := catalog.Open(c.Catalog)
+	if err != nil {
+		return err
+	}
+	x := indexer{Catalog: cat}
+	for _, o := range c.Stores {
+		for _, d := range append([]string{o.Location}, o.Fallback...) {
+			var err error
+			switch o.Scheme {
+			case "file":
+				err = x.indexFiles(d, o)
+			case "tar", "archive":
+				err = x.indexArchives(d, o)
+			default:
+				continue
+			}
+			if err != nil {
+				cat.Close()
+				return err
+			}
+		}
+	}
+	if err := cat.Close(); err != nil {
+		return err
+	}
+	log.Printf("%d products indexed, %d files skipped", x.count, x.skipped)
+	return nil
+}
+
+func (x *indexer) indexFiles(d string, o storage.Options) error {
+	layout := storage.NewLayout(d, o.Epoch, o.Levels, o.Interval)
+	return filepath.Walk(d, func(p string, i os.FileInfo, err error) error {
+		if err != nil || !i.Mode().IsRegular() || skipIndex(p) {
+			return err
+		}
+		v, err := storage.Describe(layout, p)
+		if err != nil {
+			x.skipped++
+			return nil
+		}
+		x.Add(storage.EntryOf(v, i.Size(), catalog.Location{Scheme: "file", File: p}))
+		x.count++
+		return nil
+	})
+}
+
+func (x *indexer) indexArchives(d string, o storage.Options) error {
+	layout := storage.NewLayout("", o.Epoch, o.Levels, o.Interval)
+	return filepath.Walk(d, func(p string, i os.FileInfo, err error) error {
+		if err != nil || !i.Mode().IsRegular() || filepath.Ext(p) != storage.TAR {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var (
+			tr   = tar.NewReader(f)
+			last storage.Product
+			name string
+			size int64
+		)
+		flush := func() {
+			if name == "" {
+				return
+			}
+			x.Add(storage.EntryOf(last, size, catalog.Location{Scheme: "tar", File: p, Member: name}))
+			x.count++
+			name = ""
+		}
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("%s: %s", p, err)
+				break
+			}
+			// sidecars are written just after their product
+			if e := filepath.Ext(h.Name); e == storage.XML || e == storage.JSON {
+				if name != "" && h.Name == name+e {
+					if m, err := storage.DecodeMetadata(tr, h.Name); err == nil {
+						last = last.WithMetadata(m)
+					}
+				}
+				continue
+			}
+			flush()
+			v, err := storage.DescribeName(layout, h.Name)
+			if err != nil {
+				x.skipped++
+				continue
+			}
+			last, name, size = v, h.Name, h.Size
+		}
+		flush()
+		return nil
+	})
+}
+
+func skipIndex(p string) bool {
+	if strings.HasPrefix(filepath.Base(p), storage.MANIFEST) {
+		return true
+	}
+	e := filepath.Ext(strings.TrimSuffix(p, storage.BAD))
+	return e == storage.XML || e == storage.JSON
+}
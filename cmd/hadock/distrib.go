@@ -28,7 +28,13 @@ func runDistrib(cmd *cli.Command, args []string) error {
 		Rate    int      `toml:"ratelimit"`
 		Rawdir  string   `toml:"rawdir"`
 		Datadir string   `toml:"datadir"`
+		Cache   int      `toml:"cache-size"`
 		Groups  []string `toml:"groups"`
+		Mirror  bool     `toml:"mirror"`
+		Secret  string   `toml:"mirror-secret"`
+		Catalog string   `toml:"catalog"`
+		Schemas string   `toml:"schemas"`
+		Calibs  string   `toml:"calibrations"`
 	}{}
 	if err := toml.Decode(f, &c); err != nil {
 		return err
@@ -50,7 +56,7 @@ func runDistrib(cmd *cli.Command, args []string) error {
 	} else {
 		log.Println("monitor:", err)
 	}
-	if h, err := distrib.Fetch(c.Rawdir, c.Datadir); err == nil {
+	if h, err := distrib.Fetch(c.Rawdir, c.Datadir, int64(c.Cache)<<20, c.Schemas, c.Calibs); err == nil {
 		http.Handle("/products/", http.StripPrefix("/products/", distrib.Limit(h, c.Rate)))
 	} else {
 		log.Println("products:", err)
@@ -60,9 +66,38 @@ func runDistrib(cmd *cli.Command, args []string) error {
 	} else {
 		log.Println("archives:", err)
 	}
+	if c.Catalog != "" {
+		if h, err := distrib.Search(c.Catalog, c.Rawdir); err == nil {
+			http.Handle("/search", h)
+		} else {
+			log.Println("search:", err)
+		}
+		if h, err := distrib.Series(c.Catalog, c.Schemas, c.Calibs); err == nil {
+			http.Handle("/series", h)
+		} else {
+			log.Println("series:", err)
+		}
+		if h, err := distrib.Sequence(c.Catalog); err == nil {
+			http.Handle("/sequence", h)
+		} else {
+			log.Println("sequence:", err)
+		}
+		if h, err := distrib.Regenerate(c.Catalog); err == nil {
+			http.Handle("/hrdp", h)
+		} else {
+			log.Println("hrdp:", err)
+		}
+	}
+	if c.Mirror {
+		if h, err := distrib.Receive(c.Rawdir, c.Secret); err == nil {
+			http.Handle("/mirror/", http.StripPrefix("/mirror/", h))
+		} else {
+			log.Println("mirror:", err)
+		}
+	}
 	opts := []handlers.CORSOption{
-		handlers.AllowedHeaders([]string{"if-modified-since"}),
-		handlers.ExposedHeaders([]string{"last-modified"}),
+		handlers.AllowedHeaders([]string{"if-modified-since", "if-none-match", "if-range", "range"}),
+		handlers.ExposedHeaders([]string{"last-modified", "etag", "link", "accept-ranges", "content-range", "calibration"}),
 	}
 	h := handlers.CORS(opts...)(http.DefaultServeMux)
 	if !*quiet {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/busoc/hadock/catalog"
+	"github.com/busoc/hadock/storage"
+	"github.com/busoc/panda"
+	"github.com/midbel/cli"
+)
+
+func runExport(cmd *cli.Command, args []string) error {
+	channel := cmd.Flag.String("c", "", "channel (vic1, vic2 or lrsd)")
+	origin := cmd.Flag.String("o", "", "origin")
+	mode := cmd.Flag.String("m", "", "mode (realtime or playback)")
+	datadir := cmd.Flag.String("d", "", "directory of the HRDP files (stdout when empty)")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	var (
+		q   = catalog.Query{Instance: -1, Origin: *origin, Mode: *mode}
+		c   panda.Channel
+		err error
+	)
+	if *channel != "" {
+		var ok bool
+		if c, ok = storage.ParseChannel(*channel); !ok {
+			return fmt.Errorf("invalid channel %s", *channel)
+		}
+	}
+	if q.Starts, err = time.Parse(time.RFC3339, cmd.Flag.Arg(1)); err != nil {
+		return fmt.Errorf("invalid starts %s", cmd.Flag.Arg(1))
+	}
+	if q.Ends, err = time.Parse(time.RFC3339, cmd.Flag.Arg(2)); err != nil {
+		return fmt.Errorf("invalid ends %s", cmd.Flag.Arg(2))
+	}
+	file := cmd.Flag.Arg(0)
+	if *datadir == "" {
+		n, err := storage.Export(os.Stdout, file, q, c)
+		log.Printf("%d packets exported", n)
+		return err
+	}
+	// files are laid out as in the HRDP archive with one file by hour
+	var total int
+	for t := q.Starts; t.Before(q.Ends); t = t.Truncate(time.Hour).Add(time.Hour) {
+		x := q
+		x.Starts, x.Ends = t, t.Truncate(time.Hour).Add(time.Hour-1)
+		if x.Ends.After(q.Ends) {
+			x.Ends = q.Ends
+		}
+		n, err := exportFile(*datadir, file, x, c)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	log.Printf("%d packets exported", total)
+	return nil
+}
+
+func exportFile(datadir, file string, q catalog.Query, c panda.Channel) (int, error) {
+	t := q.Starts.UTC()
+	dir := filepath.Join(datadir, fmt.Sprintf("%04d", t.Year()), fmt.Sprintf("%03d", t.YearDay()), fmt.Sprintf("%02d", t.Hour()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	p := filepath.Join(dir, fmt.Sprintf("hdk_%s.dat", t.Format("150405")))
+	w, err := os.Create(p)
+	if err != nil {
+		return 0, err
+	}
+	n, err := storage.Export(w, file, q, c)
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	if n == 0 && err == nil {
+		err = os.Remove(p)
+	}
+	return n, err
+}
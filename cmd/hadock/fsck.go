@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/busoc/hadock/catalog"
+	img "github.com/busoc/hadock/internal/image"
+	"github.com/busoc/hadock/storage"
+	"github.com/busoc/hadock/vmu"
+	"github.com/busoc/panda"
+	"github.com/midbel/cli"
+	"github.com/midbel/toml"
+)
+
+const (
+	IssueHeader    = "header"
+	IssueSize      = "size"
+	IssueTruncated = "truncated"
+	IssueSidecar   = "missing-sidecar"
+	IssueOrphan    = "orphan-sidecar"
+	IssueBad       = "superseded-bad"
+)
+
+type issue struct {
+	File     string `json:"file"`
+	Member   string `json:"member,omitempty"`
+	Kind     string `json:"kind"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type checker struct {
+	repair  bool
+	catalog string
+	report  func(issue) error
+
+	files  int
+	issues int
+}
+
+func runFsck(cmd *cli.Command, args []string) error {
+	repair := cmd.Flag.Bool("r", false, "repair")
+	format := cmd.Flag.String("f", "text", "output format (text, json)")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	f, err := os.Open(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	c := struct {
+		Catalog string            `toml:"catalog"`
+		Stores  []storage.Options `toml:"storage"`
+	}{}
+	if err := toml.Decode(f, &c); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+	k := checker{repair: *repair, catalog: c.Catalog}
+	switch *format {
+	case "json":
+		e := json.NewEncoder(os.Stdout)
+		k.report = func(i issue) error { return e.Encode(i) }
+	case "text", "":
+		k.report = func(i issue) error {
+			file := i.File
+			if i.Member != "" {
+				file += ":" + i.Member
+			}
+			_, err := fmt.Fprintf(os.Stdout, "%-16s | %-5t | %s | %s\n", i.Kind, i.Repaired, file, i.Detail)
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported output format %s", *format)
+	}
+	for _, o := range c.Stores {
+		for _, d := range append([]string{o.Location}, o.Fallback...) {
+			var err error
+			switch o.Scheme {
+			case "file":
+				err = k.checkFiles(d, o)
+			case "tar", "archive":
+				err = k.checkArchives(d)
+			case "hrdp":
+				err = k.checkHRDP(d, o.Format)
+			default:
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("%d files checked, %d problems found", k.files, k.issues)
+	if k.issues > 0 {
+		return fmt.Errorf("%s: archive not clean", cmd.Flag.Arg(0))
+	}
+	return nil
+}
+
+func (k *checker) Report(i issue) error {
+	k.issues++
+	return k.report(i)
+}
+
+func (k *checker) checkFiles(d string, o storage.Options) error {
+	ext := storage.XML
+	if strings.ToLower(o.Meta) == "json" {
+		ext = storage.JSON
+	}
+	layout := storage.NewLayout(d, o.Epoch, o.Levels, o.Interval)
+	return filepath.Walk(d, func(p string, i os.FileInfo, err error) error {
+		if err != nil || !i.Mode().IsRegular() {
+			return err
+		}
+		if strings.HasPrefix(filepath.Base(p), storage.MANIFEST) {
+			return nil
+		}
+		k.files++
+		switch e := filepath.Ext(p); e {
+		case storage.XML, storage.JSON:
+			base := strings.TrimSuffix(p, e)
+			if fileExists(base) || fileExists(base+storage.BAD) {
+				return nil
+			}
+			return k.Report(issue{File: p, Kind: IssueOrphan, Detail: "no data for sidecar"})
+		case storage.BAD:
+			good := strings.TrimSuffix(p, e)
+			if x := filepath.Ext(good); x == storage.XML || x == storage.JSON || !fileExists(good) {
+				return nil
+			}
+			x := issue{File: p, Kind: IssueBad, Detail: "good copy available"}
+			if k.repair {
+				x.Repaired = k.removeBad(layout, p) == nil
+			}
+			return k.Report(x)
+		}
+		if o.Format != "raw" {
+			return nil
+		}
+		bs, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		h, err := parseHeader(bs)
+		if err != nil {
+			return k.Report(issue{File: p, Kind: IssueHeader, Detail: err.Error()})
+		}
+		if err := h.Check(); err != nil {
+			if err := k.Report(issue{File: p, Kind: IssueSize, Detail: err.Error()}); err != nil {
+				return err
+			}
+		}
+		if !h.Image || fileExists(p+storage.XML) || fileExists(p+storage.JSON) {
+			return nil
+		}
+		x := issue{File: p, Kind: IssueSidecar, Detail: "image without sidecar"}
+		if k.repair {
+			x.Repaired = h.Recover(layout, p, ext, o.Manifest) == nil
+		}
+		return k.Report(x)
+	})
+}
+
+// removeBad removes a superseded bad file and its sidecar from the archive,
+// its manifest and the catalogue.
+func (k *checker) removeBad(layout storage.Layout, p string) error {
+	v, derr := storage.Describe(layout, p)
+	os.Remove(p + storage.XML)
+	os.Remove(p + storage.JSON)
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	base := filepath.Base(p)
+	if err := storage.DropManifest(filepath.Dir(p), base, base+storage.XML, base+storage.JSON); err != nil {
+		return err
+	}
+	if k.catalog == "" || derr != nil {
+		return nil
+	}
+	l := catalog.Location{Scheme: "file", File: p}
+	return catalog.Remove(k.catalog, storage.EntryOf(v, 0, l), l)
+}
+
+func (k *checker) checkArchives(d string) error {
+	return filepath.Walk(d, func(p string, i os.FileInfo, err error) error {
+		if err != nil || !i.Mode().IsRegular() || filepath.Ext(p) != storage.TAR {
+			return err
+		}
+		k.files++
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var (
+			tr     = tar.NewReader(f)
+			images []string
+			names  = make(map[string]struct{})
+		)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return k.Report(issue{File: p, Kind: IssueTruncated, Detail: err.Error()})
+			}
+			var buf bytes.Buffer
+			n, err := io.Copy(&buf, tr)
+			if err != nil {
+				return k.Report(issue{File: p, Member: h.Name, Kind: IssueTruncated, Detail: err.Error()})
+			}
+			if n != h.Size {
+				x := issue{
+					File:   p,
+					Member: h.Name,
+					Kind:   IssueSize,
+					Detail: fmt.Sprintf("want %d bytes, got %d", h.Size, n),
+				}
+				if err := k.Report(x); err != nil {
+					return err
+				}
+			}
+			names[h.Name] = struct{}{}
+			if e := filepath.Ext(h.Name); e == storage.XML || e == storage.JSON {
+				continue
+			}
+			x, err := parseHeader(buf.Bytes())
+			if err != nil {
+				if err := k.Report(issue{File: p, Member: h.Name, Kind: IssueHeader, Detail: err.Error()}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := x.Check(); err != nil {
+				if err := k.Report(issue{File: p, Member: h.Name, Kind: IssueSize, Detail: err.Error()}); err != nil {
+					return err
+				}
+			}
+			if x.Image {
+				images = append(images, h.Name)
+			}
+		}
+		for _, n := range images {
+			_, x := names[n+storage.XML]
+			_, j := names[n+storage.JSON]
+			if x || j {
+				continue
+			}
+			if err := k.Report(issue{File: p, Member: n, Kind: IssueSidecar, Detail: "image without sidecar"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (k *checker) checkHRDP(d, format string) error {
+	var (
+		order  binary.ByteOrder
+		offset int
+	)
+	switch strings.ToLower(format) {
+	case "hrdp", "vmu":
+		order, offset = binary.LittleEndian, 0
+	case "hadock", "hdk":
+		order, offset = binary.BigEndian, storage.HRDPHeaderSize
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return filepath.Walk(d, func(p string, i os.FileInfo, err error) error {
+		if err != nil || !i.Mode().IsRegular() || filepath.Ext(p) != ".dat" {
+			return err
+		}
+		k.files++
+
+		bs, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		for pos, n := 0, 0; len(bs) > 0; n++ {
+			if len(bs) < 4 {
+				return k.Report(issue{File: p, Kind: IssueTruncated, Detail: fmt.Sprintf("packet #%d at %d: incomplete size", n, pos)})
+			}
+			z := int(order.Uint32(bs))
+			if len(bs)-4 < z {
+				x := issue{
+					File:   p,
+					Kind:   IssueTruncated,
+					Detail: fmt.Sprintf("packet #%d at %d: want %d bytes, got %d", n, pos, z, len(bs)-4),
+				}
+				return k.Report(x)
+			}
+			vs := bs[4 : 4+z]
+			if offset == 0 {
+				z := vmu.HRDPHeaderLen + 4
+				if len(vs) < z || binary.BigEndian.Uint32(vs[vmu.HRDPHeaderLen:]) != vmu.HRDLMagic {
+					if err := k.Report(issue{File: p, Kind: IssueHeader, Detail: fmt.Sprintf("packet #%d at %d: invalid HRDL sync", n, pos)}); err != nil {
+						return err
+					}
+				}
+			} else if len(vs) < offset {
+				if err := k.Report(issue{File: p, Kind: IssueHeader, Detail: fmt.Sprintf("packet #%d at %d: short header", n, pos)}); err != nil {
+					return err
+				}
+			} else if h, err := parseHeader(vs[offset:]); err != nil {
+				if err := k.Report(issue{File: p, Kind: IssueHeader, Detail: fmt.Sprintf("packet #%d at %d: %s", n, pos, err)}); err != nil {
+					return err
+				}
+			} else if err := h.Check(); err != nil {
+				if err := k.Report(issue{File: p, Kind: IssueSize, Detail: fmt.Sprintf("packet #%d at %d: %s", n, pos, err)}); err != nil {
+					return err
+				}
+			}
+			bs, pos = bs[4+z:], pos+4+z
+		}
+		return nil
+	})
+}
+
+type header struct {
+	FCC      uint32
+	Sequence uint32
+	When     int64
+	X, Y     uint16
+	Image    bool
+	Size     int
+}
+
+// parseHeader decodes the header written by the raw format of the storages:
+// fcc (4) + sequence (4) + time (8) and x (2) + y (2) for images.
+func parseHeader(bs []byte) (header, error) {
+	var h header
+	if len(bs) < 16 {
+		return h, fmt.Errorf("short header (%d bytes)", len(bs))
+	}
+	fcc := bs[:4]
+	for _, b := range fcc {
+		if b < ' ' || b > '~' {
+			return h, fmt.Errorf("invalid fcc %x", fcc)
+		}
+	}
+	h.FCC = binary.BigEndian.Uint32(bs)
+	h.Sequence = binary.BigEndian.Uint32(bs[4:])
+	h.When = int64(binary.BigEndian.Uint64(bs[8:]))
+	h.Size = len(bs) - 16
+	if !img.IsImage(fcc) {
+		return h, nil
+	}
+	if len(bs) < 20 {
+		return h, fmt.Errorf("short image header (%d bytes)", len(bs))
+	}
+	h.Image = true
+	h.X = binary.BigEndian.Uint16(bs[16:])
+	h.Y = binary.BigEndian.Uint16(bs[18:])
+	h.Size = len(bs) - 20
+	return h, nil
+}
+
+func (h header) Check() error {
+	if !h.Image {
+		return nil
+	}
+	fcc := make([]byte, 4)
+	binary.BigEndian.PutUint32(fcc, h.FCC)
+
+	want, ok := img.FrameSize(fcc, int(h.X), int(h.Y))
+	if !ok {
+		return nil
+	}
+	if want != h.Size {
+		return fmt.Errorf("%s %dx%d: want %d bytes, got %d", fcc, h.X, h.Y, want, h.Size)
+	}
+	return nil
+}
+
+// Recover writes the sidecar of the product in file with the information
+// available in its header and its location when its original sidecar is lost.
+// The sidecar is added to the manifest of the directory when alg is set.
+func (h header) Recover(layout storage.Layout, file, ext, alg string) error {
+	if !h.Image {
+		return fmt.Errorf("%s: not an image", file)
+	}
+	v, err := storage.DescribeName(layout, file)
+	if err != nil {
+		return err
+	}
+	i := panda.IDHv2{
+		Acquisition: time.Duration(h.When),
+		Pixels:      panda.Pixels{X: h.X, Y: h.Y},
+	}
+	var buf bytes.Buffer
+	if err := storage.EncodeMetadata(&buf, storage.RecoveredMetadata(v, &i), ext); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+ext, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if alg == "" {
+		return nil
+	}
+	sum, err := storage.Checksum(alg, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	return storage.AppendManifest(filepath.Join(dir, storage.MANIFEST+"."+strings.ToLower(alg)), filepath.Base(file+ext), sum)
+}
+
+func fileExists(p string) bool {
+	i, err := os.Stat(p)
+	return err == nil && i.Mode().IsRegular()
+}
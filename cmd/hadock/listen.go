@@ -2,17 +2,22 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"plugin"
+	"syscall"
 	"time"
 
 	"github.com/busoc/hadock"
 	"github.com/busoc/hadock/cascading"
+	"github.com/busoc/hadock/catalog"
 	"github.com/busoc/hadock/storage"
 	"github.com/busoc/panda"
 	"github.com/midbel/cli"
@@ -42,6 +47,8 @@ func runListen(cmd *cli.Command, args []string) error {
 		Proxy     proxy             `toml:"proxy"`
 		Instances []uint8           `toml:"instances"`
 		Stores    []storage.Options `toml:"storage"`
+		Catalog   string            `toml:"catalog"`
+		Monitor   string            `toml:"monitor"`
 		Pool      pool              `toml:"pool"`
 		Modules   []module          `toml:"module"`
 	}{}
@@ -50,14 +57,34 @@ func runListen(cmd *cli.Command, args []string) error {
 	} else {
 		f.Close()
 	}
-	fs, err := setupStorage(c.Stores)
+	pool, err := setupPool(c.Pool)
 	if err != nil {
 		return err
 	}
-	pool, err := setupPool(c.Pool)
+	var record func(catalog.Entry)
+	if c.Catalog != "" {
+		cat, err := catalog.Open(c.Catalog)
+		if err != nil {
+			return err
+		}
+		defer cat.Close()
+		record = cat.Add
+	}
+	fs, err := setupStorage(c.Stores, pool, record)
 	if err != nil {
 		return err
 	}
+	// workers are drained before the catalogue is closed
+	defer func() {
+		if c, ok := fs.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Printf("closing storage failed: %s", err)
+			}
+		}
+	}()
+	if c.Monitor != "" {
+		go serveMonitor(c.Monitor, fs)
+	}
 
 	df, err := Decode(c.Mode)
 	if err != nil {
@@ -86,7 +113,25 @@ func runListen(cmd *cli.Command, args []string) error {
 		}()
 	}
 
-	for i := range Convert(ps, int(c.Buffer)) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	items := Convert(ps, int(c.Buffer))
+	for {
+		var (
+			i  *hadock.Item
+			ok bool
+		)
+		select {
+		case i, ok = <-items:
+		case s := <-sig:
+			log.Printf("%s received: stop storing packets", s)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
 		if err := fs.Store(uint8(i.Instance), i.HRPacket); err != nil {
 			log.Printf("storing VMU packet %s failed: %s", i.HRPacket.Filename(), err)
 		}
@@ -96,7 +141,6 @@ func runListen(cmd *cli.Command, args []string) error {
 		default:
 		}
 	}
-	return nil
 	// var (
 	// 	grp  errgroup.Group
 	// 	sema     = make(chan struct{}, int(c.Parallel))
@@ -140,6 +184,17 @@ func runListen(cmd *cli.Command, args []string) error {
 	// return grp.Wait()
 }
 
+// serveMonitor gives the stats of the storages of fs as JSON on /monitor.
+func serveMonitor(addr string, fs storage.Storage) {
+	http.HandleFunc("/monitor", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(storage.Statistics(fs))
+	})
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Printf("monitor: %s", err)
+	}
+}
+
 func Decode(mode string) (decodeFunc, error) {
 	var df decodeFunc
 	switch mode {
@@ -368,7 +423,7 @@ func setupPool(p pool) (*hadock.Pool, error) {
 	return hadock.NewPool(ns, age, delay), nil
 }
 
-func setupStorage(vs []storage.Options) (storage.Storage, error) {
+func setupStorage(vs []storage.Options, p *hadock.Pool, record func(catalog.Entry)) (storage.Storage, error) {
 	if len(vs) == 0 {
 		return nil, fmt.Errorf("no storage defined! abort")
 	}
@@ -378,6 +433,7 @@ func setupStorage(vs []storage.Options) (storage.Storage, error) {
 			err error
 			s   storage.Storage
 		)
+		v.Alert, v.Record = p.Alert, record
 		switch v.Scheme {
 		default:
 			err = fmt.Errorf("%s: unrecognized storage type", v.Scheme)
@@ -405,7 +461,7 @@ func setupStorage(vs []storage.Options) (storage.Storage, error) {
 		if err != nil {
 			return nil, err
 		}
-		fs = append(fs, s)
+		fs = append(fs, storage.Async(s, v))
 	}
 	return storage.Multistore(fs...), nil
 }
@@ -414,7 +470,15 @@ func mkdirAll(v storage.Options) error {
 	if err := os.MkdirAll(v.Location, 0755); v.Location != "" && err != nil {
 		return err
 	}
+	for _, f := range v.Fallback {
+		if err := os.MkdirAll(f, 0755); f != "" && err != nil {
+			return err
+		}
+	}
 	for _, s := range v.Shares {
+		if s.Link == "mirror" {
+			continue
+		}
 		if err := os.MkdirAll(s.Location, 0755); s.Location != "" && err != nil {
 			return err
 		}
@@ -39,6 +39,31 @@ var commands = []*cli.Command{
 		Short: "monitor hadock activities",
 		Run:   runMonitor,
 	},
+	{
+		Usage: "fsck [-r] [-f format] <hdk.toml>",
+		Short: "check integrity of archives",
+		Run:   runFsck,
+	},
+	{
+		Usage: "relayout [-m] [-n] [-e count] <relayout.toml>",
+		Short: "move products of an archive to a new directory tree",
+		Run:   runRelayout,
+	},
+	{
+		Usage: "verify [-v] <path...>",
+		Short: "verify checksums of stored products against their manifests",
+		Run:   runVerify,
+	},
+	{
+		Usage: "catalog [-r] <hdk.toml>",
+		Short: "rebuild the catalog of products from the archives",
+		Run:   runCatalog,
+	},
+	{
+		Usage: "export [-c channel] [-o origin] [-m mode] [-d datadir] <catalog> <starts> <ends>",
+		Short: "rebuild the HRDP packets of the products of an archive",
+		Run:   runExport,
+	},
 	{
 		Usage: "dispatch <directory>",
 		Short: "",
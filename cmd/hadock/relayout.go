@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/busoc/hadock/storage"
+	"github.com/midbel/cli"
+	"github.com/midbel/toml"
+)
+
+func runRelayout(cmd *cli.Command, args []string) error {
+	move := cmd.Flag.Bool("m", false, "move products instead of linking them")
+	dry := cmd.Flag.Bool("n", false, "only print where products would go")
+	every := cmd.Flag.Int("e", 1000, "write a checkpoint every n products")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	f, err := os.Open(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	c := struct {
+		Checkpoint string          `toml:"checkpoint"`
+		Source     storage.Options `toml:"source"`
+		Target     storage.Options `toml:"target"`
+	}{}
+	if err := toml.Decode(f, &c); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+	var (
+		src = storage.NewLayout(c.Source.Location, c.Source.Epoch, c.Source.Levels, c.Source.Interval)
+		dst = storage.NewLayout(c.Target.Location, c.Target.Epoch, c.Target.Levels, c.Target.Interval)
+	)
+	last := readCheckpoint(c.Checkpoint)
+
+	transfer := os.Link
+	if *move {
+		transfer = os.Rename
+	}
+	var (
+		count, skipped, missing int
+		sums                    manifests
+	)
+	err = filepath.Walk(c.Source.Location, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			// sidecars are moved with their product
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if last != "" {
+			// everything before the checkpoint has already been processed
+			if i.IsDir() && !strings.HasPrefix(last, p+string(filepath.Separator)) && p != c.Source.Location {
+				return filepath.SkipDir
+			}
+			if p == last {
+				last = ""
+			}
+			return nil
+		}
+		if !i.Mode().IsRegular() {
+			return nil
+		}
+		if e := filepath.Ext(p); e == storage.XML || e == storage.JSON {
+			return nil
+		}
+		// manifests are rebuilt from the products moved to the target
+		if strings.HasPrefix(filepath.Base(p), storage.MANIFEST) {
+			return nil
+		}
+		x, err := storage.Describe(src, p)
+		if err != nil {
+			skipped++
+			log.Printf("skipping %s: %s", p, err)
+			return nil
+		}
+		if ls := storage.Missing(dst, x); len(ls) > 0 {
+			missing++
+			log.Printf("skipping %s: no value for level(s) %s", p, strings.Join(ls, ", "))
+			return nil
+		}
+		dir := dst.Locate(x)
+		if !*dry {
+			if dir, err = dst.Resolve(x); err != nil {
+				return err
+			}
+		}
+		var names []string
+		for _, f := range []string{p, p + storage.XML, p + storage.JSON} {
+			if _, err := os.Stat(f); err != nil {
+				continue
+			}
+			file := filepath.Join(dir, filepath.Base(f))
+			if *dry {
+				fmt.Printf("%s -> %s\n", f, file)
+				continue
+			}
+			if err := sums.Copy(f, dir, c.Target.Manifest); err != nil {
+				return err
+			}
+			if err := transfer(f, file); err != nil && !os.IsExist(err) {
+				return err
+			}
+			names = append(names, filepath.Base(f))
+		}
+		if *move && len(names) > 0 {
+			if err := storage.DropManifest(filepath.Dir(p), names...); err != nil {
+				return err
+			}
+		}
+		if count++; !*dry && *every > 0 && count%*every == 0 {
+			writeCheckpoint(c.Checkpoint, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%d products relocated, %d skipped", count, skipped+missing)
+	if missing > 0 {
+		return fmt.Errorf("%d products not relocated: levels of target unknown in source", missing)
+	}
+	if c.Checkpoint != "" && !*dry {
+		os.Remove(c.Checkpoint)
+	}
+	return nil
+}
+
+// manifests keeps the checksums found in the manifests of the last directory
+// of the source.
+type manifests struct {
+	dir  string
+	sums map[string]map[string]string
+}
+
+// Copy appends the checksums of file found in the manifests of its directory
+// to the manifests of the same name in dir. The checksum is computed with alg
+// when the source has no manifest for it.
+func (m *manifests) Copy(file, dir, alg string) error {
+	if d := filepath.Dir(file); d != m.dir {
+		m.dir, m.sums = d, make(map[string]map[string]string)
+		fs, _ := filepath.Glob(filepath.Join(d, storage.MANIFEST+".*"))
+		for _, f := range fs {
+			if filepath.Ext(f) == ".tmp" {
+				continue
+			}
+			sums, err := storage.ReadManifest(f)
+			if err != nil {
+				return err
+			}
+			m.sums[filepath.Base(f)] = sums
+		}
+	}
+	name := filepath.Base(file)
+	for n, sums := range m.sums {
+		if sum, ok := sums[name]; ok {
+			if err := storage.AppendManifest(filepath.Join(dir, n), name, sum); err != nil {
+				return err
+			}
+		}
+	}
+	if alg == "" {
+		return nil
+	}
+	n := storage.MANIFEST + "." + strings.ToLower(alg)
+	if _, ok := m.sums[n][name]; ok {
+		return nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sum, err := storage.Checksum(alg, bs)
+	if err != nil {
+		return err
+	}
+	return storage.AppendManifest(filepath.Join(dir, n), name, sum)
+}
+
+func readCheckpoint(file string) string {
+	if file == "" {
+		return ""
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	last := strings.TrimSpace(string(bs))
+	if _, err := os.Stat(last); err != nil {
+		// the product has been moved: the walk will not find it anymore
+		return ""
+	}
+	return last
+}
+
+func writeCheckpoint(file, last string) error {
+	if file == "" {
+		return nil
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(last+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/busoc/hadock/storage"
+	"github.com/midbel/cli"
+)
+
+type verifier struct {
+	verbose bool
+
+	files  int
+	failed int
+}
+
+func runVerify(cmd *cli.Command, args []string) error {
+	verbose := cmd.Flag.Bool("v", false, "verbose")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	v := verifier{verbose: *verbose}
+	for _, a := range cmd.Flag.Args() {
+		err := filepath.Walk(a, func(p string, i os.FileInfo, err error) error {
+			if err != nil || !i.Mode().IsRegular() {
+				return err
+			}
+			alg := strings.TrimPrefix(filepath.Ext(p), ".")
+			switch base := strings.TrimSuffix(p, "."+alg); {
+			case filepath.Base(base) == storage.MANIFEST:
+				return v.verifyFiles(p, alg)
+			case filepath.Ext(base) == storage.TAR:
+				return v.verifyArchive(p, base, alg)
+			default:
+				return nil
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("%d files verified, %d failures", v.files, v.failed)
+	if v.failed > 0 {
+		return fmt.Errorf("checksums mismatched")
+	}
+	return nil
+}
+
+func (v *verifier) verifyFiles(file, alg string) error {
+	sums, err := storage.ReadManifest(file)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	for n, sum := range sums {
+		p := filepath.Join(dir, n)
+		bs, err := ioutil.ReadFile(p)
+		if err != nil {
+			v.Report(p, "", err.Error())
+			continue
+		}
+		if err := v.Compare(p, "", alg, sum, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *verifier) verifyArchive(file, archive, alg string) error {
+	sums, err := storage.ReadManifest(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		v.Report(archive, "", err.Error())
+		return nil
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.Report(archive, "", err.Error())
+			break
+		}
+		sum, ok := sums[h.Name]
+		if !ok {
+			continue
+		}
+		delete(sums, h.Name)
+		bs, err := ioutil.ReadAll(tr)
+		if err != nil {
+			v.Report(archive, h.Name, err.Error())
+			continue
+		}
+		if err := v.Compare(archive, h.Name, alg, sum, bs); err != nil {
+			return err
+		}
+	}
+	for n := range sums {
+		v.Report(archive, n, "missing from archive")
+	}
+	return nil
+}
+
+func (v *verifier) Compare(file, member, alg, want string, bs []byte) error {
+	got, err := storage.Checksum(alg, bs)
+	if err != nil {
+		return err
+	}
+	v.files++
+	if got != want {
+		v.Report(file, member, fmt.Sprintf("want %s, got %s", want, got))
+		return nil
+	}
+	if v.verbose {
+		fmt.Fprintf(os.Stdout, "OK     | %s\n", joinMember(file, member))
+	}
+	return nil
+}
+
+func (v *verifier) Report(file, member, detail string) {
+	v.failed++
+	fmt.Fprintf(os.Stdout, "FAILED | %s | %s\n", joinMember(file, member), detail)
+}
+
+func joinMember(file, member string) string {
+	if member == "" {
+		return file
+	}
+	return file + ":" + member
+}
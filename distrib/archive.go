@@ -3,16 +3,28 @@ package distrib
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/busoc/hadock/storage"
+	"github.com/klauspost/compress/zstd"
 )
 
+// Manifest is the name of the member of an archive giving the SHA256 of the
+// other members (in the format of sha256sum).
+const Manifest = "manifest.sha256"
+
 type downloader string
 
 type query struct {
@@ -21,6 +33,51 @@ type query struct {
 	Level int64
 	Flat  bool
 	Meta  bool
+
+	Starts time.Time
+	Ends   time.Time
+	Origin string
+	UPI    string
+	Format string
+	Glob   string
+}
+
+// Match tells if the file p should be included in the archive. Metadata
+// files are selected by the properties of their product.
+func (q *query) Match(p string) bool {
+	if q.Glob != "" {
+		if ok, _ := filepath.Match(q.Glob, filepath.Base(p)); !ok {
+			return false
+		}
+	}
+	if q.Starts.IsZero() && q.Ends.IsZero() && q.Origin == "" && q.UPI == "" && q.Format == "" {
+		return true
+	}
+	f, err := storage.ParseFilename(p)
+	if err != nil {
+		return false
+	}
+	if (!q.Starts.IsZero() && f.ACQ.Before(q.Starts)) || (!q.Ends.IsZero() && f.ACQ.After(q.Ends)) {
+		return false
+	}
+	if q.Origin != "" && !strings.EqualFold(q.Origin, f.Origin) {
+		return false
+	}
+	if q.Format != "" && !strings.EqualFold(q.Format, f.Format) {
+		return false
+	}
+	if q.UPI != "" {
+		if isMetadata(p) {
+			p = strings.TrimSuffix(p, filepath.Ext(p))
+		}
+		for _, ext := range []string{storage.XML, storage.JSON} {
+			if m, err := storage.ReadMetadata(p + ext); err == nil {
+				return m.UPI == q.UPI
+			}
+		}
+		return false
+	}
+	return true
 }
 
 func Download(d string) (http.Handler, error) {
@@ -29,7 +86,7 @@ func Download(d string) (http.Handler, error) {
 		return nil, err
 	}
 	if !i.IsDir() {
-		return nil, fmt.Errorf("not a directory", d)
+		return nil, fmt.Errorf("%s: not a directory", d)
 	}
 	return downloader(d), nil
 }
@@ -37,34 +94,76 @@ func Download(d string) (http.Handler, error) {
 func (d downloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	q, err := parseQuery(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	n := fmt.Sprintf("attachment; filename=%s.%s", q.File, q.Type)
-	switch p := filepath.Join(string(d), r.URL.Path); q.Type {
+	var (
+		a    archiver
+		mime string
+	)
+	switch q.Type {
 	case "tar":
-		w.Header().Set("content-disposition", n)
-		w.Header().Set("content-type", "application/x-tar")
-		writeTar(w, p, string(d), q.Flat, q.Meta)
+		a, mime = newTar(w, nil), "application/x-tar"
+	case "tgz", "tar.gz":
+		z, err := gzip.NewWriterLevel(w, level(q.Level, gzip.DefaultCompression))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, mime = newTar(z, z), "application/gzip"
+	case "zst", "tar.zst":
+		z, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level(q.Level, 3))))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, mime = newTar(z, z), "application/zstd"
 	case "zip":
-		w.Header().Set("content-disposition", n)
-		w.Header().Set("content-type", "application/zip")
-		writeZip(w, p, string(d), q.Flat, q.Meta)
+		if q.Level < flate.HuffmanOnly || q.Level > flate.BestCompression {
+			http.Error(w, fmt.Sprintf("invalid level %d", q.Level), http.StatusBadRequest)
+			return
+		}
+		a, mime = newZip(w, level(q.Level, flate.DefaultCompression)), "application/zip"
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%s.%s", q.File, q.Type))
+	w.Header().Set("content-type", mime)
+	// the response has started: errors can only be logged
+	if err := writeArchive(a, filepath.Join(string(d), r.URL.Path), string(d), q); err != nil {
+		log.Printf("archive %s: %s", r.URL.Path, err)
+	}
+}
+
+// level gives the compression level to use, def when none is given.
+func level(v int64, def int) int {
+	if v == 0 {
+		return def
+	}
+	return int(v)
 }
 
-func writeTar(w io.Writer, datadir, strip string, flat, meta bool) error {
-	tw := tar.NewWriter(w)
-	defer tw.Close()
+type archiver interface {
+	Create(string, int64, time.Time) (io.Writer, error)
+	Close() error
+}
 
+// writeArchive writes the files of datadir selected by q in a followed by
+// their manifest. Names of the members are relative to strip or only the
+// names of the files when q.Flat is set. Flat names already given (eg: the
+// realtime and playback copies of a product) are prefixed with the names of
+// their parent directories until they are unique.
+func writeArchive(a archiver, datadir, strip string, q *query) error {
+	var (
+		m    bytes.Buffer
+		seen = make(map[string]bool)
+	)
 	err := filepath.Walk(datadir, func(p string, i os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if i.IsDir() || (!meta && filepath.Ext(p) == ".xml") {
+		if i.IsDir() || (!q.Meta && isMetadata(p)) || !q.Match(p) {
 			return nil
 		}
 		f, err := os.Open(p)
@@ -72,59 +171,112 @@ func writeTar(w io.Writer, datadir, strip string, flat, meta bool) error {
 			return nil
 		}
 		defer f.Close()
-		n := strings.TrimPrefix(p, strip)
-		if flat {
-			n = filepath.Base(p)
+		n := strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(p, strip)), "/")
+		if q.Flat {
+			n = flatName(n, seen)
 		}
-		h := &tar.Header{
-			Name:    n,
-			Size:    i.Size(),
-			Mode:    0644,
-			ModTime: i.ModTime(),
+		w, err := a.Create(n, i.Size(), i.ModTime())
+		if err != nil {
+			return err
 		}
-		if err := tw.WriteHeader(h); err != nil {
+		s := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, s), f); err != nil {
 			return err
 		}
-		_, err = io.Copy(tw, f)
-		return err
+		fmt.Fprintf(&m, "%x  %s\n", s.Sum(nil), n)
+		return nil
 	})
+	if err == nil {
+		var w io.Writer
+		if w, err = a.Create(Manifest, int64(m.Len()), time.Now()); err == nil {
+			_, err = m.WriteTo(w)
+		}
+	}
+	if e := a.Close(); err == nil {
+		err = e
+	}
 	return err
 }
 
-func writeZip(w io.Writer, datadir, strip string, flat, meta bool) error {
-	zw := zip.NewWriter(w)
-	defer zw.Close()
-
-	err := filepath.Walk(datadir, func(p string, i os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if i.IsDir() || (!meta && filepath.Ext(p) == ".xml") {
-			return nil
+// flatName gives the base of the name n prefixed with as few of its parent
+// directories as needed for the name not to be in seen.
+func flatName(n string, seen map[string]bool) string {
+	ps := strings.Split(n, "/")
+	for i := len(ps) - 1; i >= 0; i-- {
+		x := strings.Join(ps[i:], "_")
+		if !seen[x] {
+			seen[x] = true
+			return x
 		}
-		f, err := os.Open(p)
-		if err != nil {
-			return nil
-		}
-		defer f.Close()
-		n := strings.TrimPrefix(p, strip)
-		if flat {
-			n = filepath.Base(p)
+	}
+	for i := 1; ; i++ {
+		x := fmt.Sprintf("%s.%d", strings.Join(ps, "_"), i)
+		if !seen[x] {
+			seen[x] = true
+			return x
 		}
-		w, err := zw.Create(n)
-		if err != nil {
-			return err
+	}
+}
+
+type tarArchive struct {
+	writer *tar.Writer
+	closer io.Closer
+}
+
+func newTar(w io.Writer, c io.Closer) archiver {
+	return &tarArchive{writer: tar.NewWriter(w), closer: c}
+}
+
+func (t *tarArchive) Create(n string, size int64, mod time.Time) (io.Writer, error) {
+	h := tar.Header{
+		Name:    n,
+		Size:    size,
+		Mode:    0644,
+		ModTime: mod,
+	}
+	return t.writer, t.writer.WriteHeader(&h)
+}
+
+func (t *tarArchive) Close() error {
+	err := t.writer.Close()
+	if t.closer != nil {
+		if e := t.closer.Close(); err == nil {
+			err = e
 		}
-		_, err = io.Copy(w, f)
-		return err
-	})
+	}
 	return err
 }
 
+type zipArchive struct {
+	writer *zip.Writer
+}
+
+func newZip(w io.Writer, level int) archiver {
+	z := zip.NewWriter(w)
+	z.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+	return &zipArchive{writer: z}
+}
+
+func (z *zipArchive) Create(n string, _ int64, mod time.Time) (io.Writer, error) {
+	h := zip.FileHeader{
+		Name:     n,
+		Method:   zip.Deflate,
+		Modified: mod,
+	}
+	return z.writer.CreateHeader(&h)
+}
+
+func (z *zipArchive) Close() error {
+	return z.writer.Close()
+}
+
 func parseQuery(r *http.Request) (*query, error) {
 	if err := r.ParseForm(); err != nil {
 		return nil, err
 	}
+	var err error
 	q := new(query)
 	q.File = r.Form.Get("filename")
 	if q.File == "" {
@@ -132,7 +284,25 @@ func parseQuery(r *http.Request) (*query, error) {
 	}
 	q.Type = r.Form.Get("type")
 	q.Meta, _ = strconv.ParseBool(r.Form.Get("meta"))
-	q.Level, _ = strconv.ParseInt(r.Form.Get("level"), 10, 64)
-
+	q.Flat, _ = strconv.ParseBool(r.Form.Get("flat"))
+	if v := r.Form.Get("level"); v != "" {
+		if q.Level, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid level %s", v)
+		}
+	}
+	if q.Starts, err = parseTime(r.Form, "starts"); err != nil {
+		return nil, err
+	}
+	if q.Ends, err = parseTime(r.Form, "ends"); err != nil {
+		return nil, err
+	}
+	q.Origin = r.Form.Get("origin")
+	q.UPI = r.Form.Get("upi")
+	q.Format = r.Form.Get("format")
+	if q.Glob = r.Form.Get("glob"); q.Glob != "" {
+		if _, err := filepath.Match(q.Glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %s", q.Glob)
+		}
+	}
 	return q, nil
 }
@@ -9,11 +9,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/busoc/hadock/storage"
 )
 
 type browser string
@@ -28,6 +31,44 @@ type info struct {
 	Ori    int       `json:"oid" xml:"info>oid"`
 	Seq    int       `json:"sequence" xml:"info>sequence"`
 	Format string    `json:"format" xml:"info>format"`
+
+	product bool
+}
+
+type listing struct {
+	Limit  int
+	Offset int
+	Since  time.Time
+	Until  time.Time
+	Format string
+
+	// sequence range, ignored when First is negative
+	First int
+	Last  int
+}
+
+// match tells if i is selected by s. Only products (files named as products)
+// are selected when s has a filter.
+func (i info) match(s listing) bool {
+	if s.Format == "" && s.First < 0 && s.Since.IsZero() && s.Until.IsZero() {
+		return true
+	}
+	if !i.product {
+		return false
+	}
+	if !s.Since.IsZero() && i.Acq.Before(s.Since) {
+		return false
+	}
+	if !s.Until.IsZero() && i.Acq.After(s.Until) {
+		return false
+	}
+	if s.Format != "" && !strings.EqualFold(s.Format, i.Format) {
+		return false
+	}
+	if s.First >= 0 && (i.Seq < s.First || (s.Last >= 0 && i.Seq > s.Last)) {
+		return false
+	}
+	return true
 }
 
 func Browse(d string) (http.Handler, error) {
@@ -36,34 +77,95 @@ func Browse(d string) (http.Handler, error) {
 		return nil, err
 	}
 	if !i.IsDir() {
-		return nil, fmt.Errorf("not a directory", d)
+		return nil, fmt.Errorf("%s: not a directory", d)
 	}
 	return browser(d), nil
 }
 
 func (b browser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	queue, err := readDir(filepath.Join(string(b), r.URL.Path))
+	s, err := parseListing(r.URL.Query())
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(string(b), r.URL.Path)
+	d, err := os.Stat(dir)
+	if err != nil || !d.IsDir() {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	is := make([]info, 0, 1000)
-	for i := range queue {
-		is = append(is, *i)
+	all, err := readDir(dir)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	ws := new(bytes.Buffer)
+	var kind string
 	switch a := r.Header.Get("accept"); {
+	case isAcceptable(a, "application/json"):
+		kind = "json"
+	case isAcceptable(a, "application/xml"):
+		kind = "xml"
+	case isAcceptable(a, "text/csv"):
+		kind = "csv"
 	default:
 		w.WriteHeader(http.StatusNotAcceptable)
-	case isAcceptable(a, "application/json"):
+		return
+	}
+	// files overwritten in place don't change the modification time of their
+	// directory
+	mod := d.ModTime()
+	for _, i := range all {
+		if i.Mod.After(mod) {
+			mod = i.Mod
+		}
+	}
+	etag := fmt.Sprintf("\"%x-%x-%s\"", mod.UnixNano(), len(all), kind)
+	w.Header().Set("vary", "accept")
+	w.Header().Set("etag", etag)
+	w.Header().Set("last-modified", mod.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, mod) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var (
+		is   = make([]info, 0, len(all))
+		skip = s.Offset
+		more bool
+	)
+	for _, i := range all {
+		if !i.match(s) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if len(is) >= s.Limit {
+			more = true
+			break
+		}
+		is = append(is, i)
+	}
+	if more {
+		u := *r.URL
+		vs := u.Query()
+		vs.Set("offset", strconv.Itoa(s.Offset+s.Limit))
+		u.RawQuery = vs.Encode()
+		w.Header().Set("link", fmt.Sprintf("<%s>; rel=\"next\"", u.String()))
+	}
+
+	ws := new(bytes.Buffer)
+	switch kind {
+	case "json":
 		err = json.NewEncoder(ws).Encode(is)
-	case isAcceptable(a, "application/xml"):
+	case "xml":
 		v := struct {
 			XMLName xml.Name `xml:"archive"`
 			Infos   []info   `xml:"product"`
 		}{Infos: is}
 		err = xml.NewEncoder(ws).Encode(v)
-	case isAcceptable(a, "text/csv"):
+	case "csv":
 		c := csv.NewWriter(ws)
 		for _, i := range is {
 			rs := []string{i.Name, i.Mod.Format(time.RFC3339), fmt.Sprint(i.Size)}
@@ -81,36 +183,95 @@ func (b browser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, ws)
 }
 
-func readDir(p string) (<-chan *info, error) {
+func notModified(r *http.Request, etag string, mod time.Time) bool {
+	if v := r.Header.Get("if-none-match"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t == etag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	t, err := http.ParseTime(r.Header.Get("if-modified-since"))
+	return err == nil && !mod.Truncate(time.Second).After(t)
+}
+
+func parseListing(vs url.Values) (listing, error) {
+	s := listing{
+		Limit:  MaxLimit,
+		Format: vs.Get("format"),
+		First:  -1,
+		Last:   -1,
+	}
+	var err error
+	if v := vs.Get("limit"); v != "" {
+		if s.Limit, err = strconv.Atoi(v); err != nil || s.Limit <= 0 {
+			return s, fmt.Errorf("invalid limit %s", v)
+		}
+		if s.Limit > MaxLimit {
+			s.Limit = MaxLimit
+		}
+	}
+	if v := vs.Get("offset"); v != "" {
+		if s.Offset, err = strconv.Atoi(v); err != nil || s.Offset < 0 {
+			return s, fmt.Errorf("invalid offset %s", v)
+		}
+	}
+	if s.Since, err = parseTime(vs, "since"); err != nil {
+		return s, err
+	}
+	if s.Until, err = parseTime(vs, "until"); err != nil {
+		return s, err
+	}
+	// sequence is either a single value or a range (first-last) where one of
+	// the bounds can be omitted
+	if v := vs.Get("sequence"); v != "" {
+		first, last := v, v
+		if ix := strings.Index(v, "-"); ix >= 0 {
+			first, last = v[:ix], v[ix+1:]
+		}
+		if first == "" {
+			first = "0"
+		}
+		if s.First, err = strconv.Atoi(first); err != nil || s.First < 0 {
+			return s, fmt.Errorf("invalid sequence %s", v)
+		}
+		if last != "" {
+			if s.Last, err = strconv.Atoi(last); err != nil || s.Last < s.First {
+				return s, fmt.Errorf("invalid sequence %s", v)
+			}
+		}
+	}
+	return s, nil
+}
+
+func readDir(p string) ([]info, error) {
 	infos, err := ioutil.ReadDir(p)
 	if err != nil {
 		return nil, err
 	}
-	q := make(chan *info)
-	go func(is []os.FileInfo) {
-		split := func(r rune) bool {
-			return r == '_' || r == '.'
+	is := make([]info, 0, len(infos))
+	for _, i := range infos {
+		if isMetadata(i.Name()) || strings.HasPrefix(i.Name(), storage.MANIFEST) {
+			continue
 		}
-		defer close(q)
-		for _, i := range is {
-			if filepath.Ext(i.Name()) == ".xml" {
-				continue
-			}
-			n := &info{
-				Name:    filepath.Base(i.Name()),
-				Size:    i.Size(),
-				Mod:     i.ModTime(),
-				Regular: !i.IsDir(),
-			}
-			if !i.IsDir() {
-				fs := strings.FieldsFunc(n.Name, split)
-				n.Ori, _ = strconv.Atoi(fs[0])
-				n.Seq, _ = strconv.Atoi(fs[1])
-				n.Acq, _ = time.Parse("20060102_150405", fs[2]+"_"+fs[3])
-				n.Format = fs[4]
+		n := info{
+			Name:    filepath.Base(i.Name()),
+			Size:    i.Size(),
+			Mod:     i.ModTime(),
+			Regular: !i.IsDir(),
+		}
+		// files not named like a product are listed without their info
+		if !i.IsDir() {
+			if p, err := storage.ParseFilename(n.Name); err == nil {
+				n.Ori, _ = strconv.Atoi(p.Origin)
+				n.Seq = int(p.Sequence)
+				n.Acq = p.ACQ
+				n.Format = p.Format
+				n.product = true
 			}
-			q <- n
 		}
-	}(infos)
-	return q, nil
+		is = append(is, n)
+	}
+	return is, nil
 }
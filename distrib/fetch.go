@@ -4,21 +4,24 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/busoc/hadock/internal/cache"
 	img "github.com/busoc/hadock/internal/image"
 	"github.com/busoc/hadock/internal/science"
+	"github.com/busoc/hadock/storage"
 	"github.com/busoc/panda"
 	"github.com/gorilla/handlers"
 )
@@ -27,14 +30,19 @@ var (
 	ErrNotModified    = errors.New("not modified")
 	ErrNotFound       = errors.New("not found")
 	ErrNotImplemented = errors.New("not implemented")
+	ErrNoCalibration  = errors.New("no calibration found")
 )
 
 type fetcher struct {
-	rawdir  string
-	datadir string
+	rawdir       string
+	cache        *cache.Cache
+	schemas      science.Schemas
+	calibrations science.Calibrations
 }
 
 type file struct {
+	origin string
+
 	fcc  uint32
 	seq  uint32
 	when int64
@@ -42,97 +50,145 @@ type file struct {
 	buf  *bytes.Buffer
 }
 
-func (f *file) AsRaw() (io.Reader, error) {
-	r := new(bytes.Buffer)
-	binary.Write(r, binary.BigEndian, f.fcc)
-	binary.Write(r, binary.BigEndian, f.seq)
-	binary.Write(r, binary.BigEndian, f.when)
-	return io.MultiReader(r, f.buf), nil
+func (f *file) AsRaw() (io.ReadSeeker, error) {
+	var r bytes.Buffer
+	binary.Write(&r, binary.BigEndian, f.fcc)
+	binary.Write(&r, binary.BigEndian, f.seq)
+	binary.Write(&r, binary.BigEndian, f.when)
+	r.Write(f.buf.Bytes())
+	return bytes.NewReader(r.Bytes()), nil
 }
 
-func (f *file) AsScience() (io.Reader, error) {
-	fcc := make([]byte, 4)
-	binary.BigEndian.PutUint32(fcc, f.fcc)
-	var (
-		r   bytes.Buffer
-		err error
-	)
-	switch bs, m := f.buf.Bytes(), f.ModTime(); {
-	case bytes.Equal(fcc, panda.SYNC):
-		err = science.ExportSyncUnit(&r, bs, m)
-	case bytes.Equal(fcc, panda.MMA):
-		err = science.ExportScienceData(&r, bs, m)
-	case bytes.Equal(fcc, panda.SVS):
-		err = science.ExportSVSData(&r, bs)
+// AsScience gives the records of a science product as CSV, JSON, NDJSON or
+// Parquet according to m. Values are converted to engineering values when k
+// is set.
+func (f *file) AsScience(s science.Schemas, k *science.Calibration, m Mime) (io.Reader, error) {
+	c, ok := s.Lookup(f.FCC(), f.origin)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	var r bytes.Buffer
+	if m == MimeCSV && k == nil {
+		err := c.Export(&r, f.buf.Bytes(), f.ModTime())
+		return &r, err
+	}
+	t, err := c.Decode(f.buf.Bytes(), f.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	if k != nil {
+		k.Apply(t)
+		t.Header = true
+	}
+	switch m {
+	case MimeCSV:
+		err = t.WriteCSV(&r)
+	case MimeJSON:
+		err = t.WriteJSON(&r)
+	case MimeNDJSON:
+		err = t.WriteNDJSON(&r)
+	case MimeParquet:
+		err = t.WriteParquet(&r)
 	default:
 		return nil, ErrNotImplemented
 	}
 	return &r, err
 }
 
-func (f *file) AsImage(t string) (io.Reader, error) {
-	var x, y uint16
-	binary.Read(f.buf, binary.BigEndian, &x)
-	binary.Read(f.buf, binary.BigEndian, &y)
+// conversion tells how a product is converted to an image or to records.
+type conversion struct {
+	format     string
+	query      string
+	demosaic   img.Demosaic
+	roi        *img.ROI
+	transforms []img.Transform
 
-	var (
-		i   image.Image
-		err error
-	)
-	fcc := make([]byte, 4)
-	binary.BigEndian.PutUint32(fcc, f.fcc)
-	switch {
-	default:
-		err = fmt.Errorf("not supported %x", f.fcc)
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.PNG):
-		i, _, err = image.Decode(f.buf)
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.YUY2):
-		i = img.ImageLBR(int(x), int(y), f.buf.Bytes())
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.Y800):
-		i = img.ImageGray8(int(x), int(y), f.buf.Bytes())
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.I420):
-		i = img.ImageI420(int(x), int(y), f.buf.Bytes())
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.RGB):
-		i = img.ImageRGB(int(x), int(y), f.buf.Bytes())
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.Y16B):
-		i = img.ImageGray16(int(x), int(y), f.buf.Bytes(), binary.BigEndian)
-	case bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.Y16L):
-		i = img.ImageGray16(int(x), int(y), f.buf.Bytes(), binary.LittleEndian)
-	}
+	calibrated  bool
+	calibration string
+}
+
+func (f *file) AsImage(c conversion, cs []img.Card) (*bytes.Buffer, error) {
+	i, err := f.Convert(c)
 	if err != nil {
 		return nil, err
 	}
-	// for _, t := range ts {
-	// 	i = t.Transform(i)
-	// }
 	var w bytes.Buffer
-	switch t {
-	case "jpg", "jpeg":
-		err = jpeg.Encode(&w, i, &jpeg.Options{100})
-	case "png":
-		err = png.Encode(&w, i)
-	case "gif":
-		err = gif.Encode(&w, i, new(gif.Options))
-	default:
-		err = png.Encode(&w, i)
+	if c.format == "fits" {
+		err = img.EncodeFITS(&w, i, cs)
+	} else {
+		err = img.Encode(&w, i, c.format)
 	}
 	return &w, err
 }
 
+// Convert decodes the pixels of the product and applies the region of
+// interest and the transformations of c.
+func (f *file) Convert(c conversion) (image.Image, error) {
+	i, err := f.Image(c.demosaic)
+	if err != nil {
+		return nil, err
+	}
+	if c.roi != nil {
+		i = c.roi.Transform(i)
+	}
+	return img.Apply(i, c.transforms...), nil
+}
+
+// Image decodes the pixels of the product.
+func (f *file) Image(d img.Demosaic) (image.Image, error) {
+	bs := f.buf.Bytes()
+	if len(bs) < 4 {
+		return nil, fmt.Errorf("missing dimension")
+	}
+	x, y := binary.BigEndian.Uint16(bs), binary.BigEndian.Uint16(bs[2:])
+	return img.DecodeWith(f.fcc, int(x), int(y), bs[4:], d)
+}
+
+func (f *file) FCC() string {
+	fcc := make([]byte, 4)
+	binary.BigEndian.PutUint32(fcc, f.fcc)
+	return string(fcc)
+}
+
 func (f file) ModTime() time.Time {
 	return panda.AdjustGenerationTime(f.when)
 	// return time.Unix(f.when, 0)
 }
 
-func Fetch(r, d string) (http.Handler, error) {
+// Fetch serves the products found in r. When d is set, the images are kept
+// in d once converted until they take more than limit bytes. Science data are
+// decoded with the builtin schemas and the ones found in s and calibrated with
+// the calibrations found in k.
+func Fetch(r, d string, limit int64, s, k string) (http.Handler, error) {
 	i, err := os.Stat(r)
 	if err != nil {
 		return nil, err
 	}
 	if !i.IsDir() {
-		return nil, fmt.Errorf("not a directory", r)
+		return nil, fmt.Errorf("%s: not a directory", r)
+	}
+	f := fetcher{rawdir: r}
+	if f.schemas, err = science.Load(s); err != nil {
+		return nil, err
 	}
-	return handlers.CompressHandler(fetcher{rawdir: r, datadir: d}), nil
+	if f.calibrations, err = science.LoadCalibrations(k); err != nil {
+		return nil, err
+	}
+	if d != "" {
+		if f.cache, err = cache.New(d, limit); err != nil {
+			return nil, err
+		}
+	}
+	z := handlers.CompressHandler(f)
+	// ranges apply to the uncompressed representation
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "" {
+			f.ServeHTTP(w, r)
+		} else {
+			z.ServeHTTP(w, r)
+		}
+	}
+	return http.HandlerFunc(h), nil
 }
 
 type Mime string
@@ -155,6 +211,14 @@ const (
 	MimeJPG   = Mime("image/jpeg")
 	MimePNG   = Mime("image/png")
 	MimeCSV   = Mime("text/csv")
+	MimeXML   = Mime("application/xml")
+	MimeJSON  = Mime("application/json")
+	MimeTIFF  = Mime("image/tiff")
+	MimeFITS  = Mime("image/fits")
+	MimeNPY   = Mime("application/x-npy")
+
+	MimeNDJSON  = Mime("application/x-ndjson")
+	MimeParquet = Mime("application/vnd.apache.parquet")
 )
 
 var types = []Mime{
@@ -162,35 +226,70 @@ var types = []Mime{
 	MimeGif,
 	MimePNG,
 	MimeJPG,
+	MimeTIFF,
+	MimeFITS,
+	MimeNPY,
 	MimeCSV,
+	MimeNDJSON,
+	MimeParquet,
+	MimeJSON,
 }
 
 func (f fetcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if isAcceptable(r.Header.Get("accept"), "application/xml") {
-		f, err := os.Open(filepath.Join(f.rawdir, r.URL.Path))
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		defer f.Close()
-		io.Copy(w, f)
-
+	if _, ok := r.URL.Query()["stats"]; ok {
+		f.serveStats(w, r)
+		return
+	}
+	// JSON gives the records of science products and the metadata of the
+	// other products or when meta is set
+	_, meta := r.URL.Query()["meta"]
+	p := filepath.Join(f.rawdir, r.URL.Path)
+	switch a := r.Header.Get("accept"); {
+	case isAcceptable(a, MimeXML.String()):
+		f.serveMetadata(w, r, MimeXML)
+		return
+	case meta || isAcceptable(a, MimeJSON.String()) && !f.hasRecords(p):
+		f.serveMetadata(w, r, MimeJSON)
+		return
+	}
+	i, err := os.Stat(p)
+	if err != nil || !i.Mode().IsRegular() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	mime, ok := accept(r.Header.Get("accept"), types)
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
-	// if ok := f.copyFile(w, r.URL.Path); ok {
-	// 	return
-	// }
-	var mod time.Time
-	bs, err := readFile(filepath.Join(f.rawdir, r.URL.Path), mod)
+	c, err := parseConversion(r.URL, mime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// each representation of a product has its own etag
+	etag := fmt.Sprintf("%x-%x-%s", i.ModTime().UnixNano(), i.Size(), mime.SubType())
+	if c.query != "" {
+		h := fnv.New32a()
+		io.WriteString(h, c.query)
+		etag = fmt.Sprintf("%s-%x", etag, h.Sum32())
+	}
+	etag = "\"" + etag + "\""
+	w.Header().Set("etag", etag)
+	w.Header().Set("last-modified", i.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Add("vary", "accept")
+	if notModified(r, etag, i.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	bs, err := readFile(p)
 	switch err {
 	case nil:
 		break
 	case ErrNotFound:
 		w.WriteHeader(http.StatusNotFound)
 		return
-	case ErrNotModified:
-		w.WriteHeader(http.StatusNotModified)
-		return
 	case ErrNotImplemented:
 		w.WriteHeader(http.StatusNotImplemented)
 		return
@@ -199,42 +298,207 @@ func (f fetcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mime, ok := accept(r.Header.Get("accept"), types)
-	if !ok {
-		w.WriteHeader(http.StatusNotAcceptable)
-		return
-	}
 	var rs io.Reader
 	switch mime {
 	case MimeOctet:
 		rs, err = bs.AsRaw()
-	case MimeGif, MimeJPG, MimePNG:
-		rs, err = bs.AsImage(mime.SubType())
-	case MimeCSV:
-		rs, err = bs.AsScience()
+	case MimeGif, MimeJPG, MimePNG, MimeTIFF, MimeFITS, MimeNPY:
+		rs, err = f.convertImage(bs, p, c)
+	case MimeCSV, MimeJSON, MimeNDJSON, MimeParquet:
+		var k *science.Calibration
+		if k, err = f.calibrationOf(bs, c); err == nil {
+			if k != nil {
+				w.Header().Set("calibration", k.String())
+			}
+			rs, err = bs.AsScience(f.schemas, k, mime)
+		}
 	}
-	if err != nil {
+	switch err {
+	case nil:
+	case ErrNoCalibration:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrNotImplemented:
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	default:
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("etag", fmt.Sprintf("%x", bs.sum))
-	w.Header().Set("last-modified", bs.ModTime().Format(time.RFC1123))
-	w.Header().Set("expires", time.Now().Add(time.Hour*24).Format(time.RFC1123))
+	w.Header().Set("expires", time.Now().Add(time.Hour*24).UTC().Format(http.TimeFormat))
 	w.Header().Set("content-type", mime.String())
+	if c, ok := rs.(io.Closer); ok {
+		defer c.Close()
+	}
+	if rs, ok := rs.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", i.ModTime(), rs)
+		return
+	}
 	io.Copy(w, rs)
 }
 
-func (f fetcher) copyFile(w io.Writer, p string) bool {
-	r, err := os.Open(filepath.Join(f.datadir, p))
+// calibrationOf gives the calibration to apply to the records of a product,
+// nil if the records are not calibrated.
+func (f fetcher) calibrationOf(bs *file, c conversion) (*science.Calibration, error) {
+	if !c.calibrated {
+		return nil, nil
+	}
+	k, ok := f.calibrations.Find(bs.FCC(), bs.origin, bs.ModTime(), c.calibration)
+	if !ok {
+		return nil, ErrNoCalibration
+	}
+	return k, nil
+}
+
+// hasRecords tells if the product in p is a science product known by the
+// schemas.
+func (f fetcher) hasRecords(p string) bool {
+	r, err := os.Open(p)
 	if err != nil {
 		return false
 	}
 	defer r.Close()
-	io.Copy(w, r)
-	return true
+
+	fcc := make([]byte, 4)
+	if _, err := io.ReadFull(r, fcc); err != nil {
+		return false
+	}
+	var origin string
+	if p, err := storage.ParseFilename(p); err == nil {
+		origin = p.Origin
+	}
+	_, ok := f.schemas.Lookup(string(fcc), origin)
+	return ok
+}
+
+func (f fetcher) serveMetadata(w http.ResponseWriter, r *http.Request, m Mime) {
+	p := r.URL.Path
+	ext := "." + m.SubType()
+	if filepath.Ext(p) != ext {
+		p += ext
+	}
+	fd, err := os.Open(filepath.Join(f.rawdir, p))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer fd.Close()
+	i, err := fd.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", m.String())
+	http.ServeContent(w, r, "", i.ModTime(), fd)
+}
+
+// serveStats gives the statistics of the pixels of an image product.
+func (f fetcher) serveStats(w http.ResponseWriter, r *http.Request) {
+	p := filepath.Join(f.rawdir, r.URL.Path)
+	i, err := os.Stat(p)
+	if err != nil || !i.Mode().IsRegular() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	d, err := img.ParseDemosaic(r.URL.Query().Get("demosaic"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bs, err := readFile(p)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	g, err := bs.Image(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	s := img.Statistics(g)
+
+	var buf bytes.Buffer
+	m := MimeJSON
+	if a := r.Header.Get("accept"); isAcceptable(a, MimeXML.String()) {
+		m = MimeXML
+		err = xml.NewEncoder(&buf).Encode(struct {
+			XMLName xml.Name `xml:"stats"`
+			img.Stats
+		}{Stats: s})
+	} else {
+		err = json.NewEncoder(&buf).Encode(s)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", m.String())
+	http.ServeContent(w, r, "", i.ModTime(), bytes.NewReader(buf.Bytes()))
+}
+
+// convertImage gives the image of a product in the given format. Converted
+// images are cached according to the content of the product and the query of
+// the request.
+func (f fetcher) convertImage(bs *file, p string, c conversion) (io.Reader, error) {
+	var cs []img.Card
+	if c.format == "fits" || c.roi != nil {
+		cs = readSidecar(p)
+	}
+	if c.roi != nil {
+		c.roi.Geometry = geometryOf(cs)
+	}
+	if c.format != "fits" {
+		cs = nil
+	}
+	if f.cache == nil {
+		return bs.AsImage(c, cs)
+	}
+	k := cache.Key(fmt.Sprintf("%x", bs.sum), c.format, c.query)
+	if r, ok := f.cache.Get(k); ok {
+		return r, nil
+	}
+	w, err := bs.AsImage(c, cs)
+	if err != nil {
+		return nil, err
+	}
+	// failing to cache an image should not prevent to deliver it
+	f.cache.Put(k, w.Bytes())
+	return bytes.NewReader(w.Bytes()), nil
 }
 
-func readFile(p string, m time.Time) (*file, error) {
+func parseConversion(u *url.URL, m Mime) (conversion, error) {
+	c := conversion{
+		format: m.SubType(),
+		query:  u.RawQuery,
+	}
+	var err error
+	if c.transforms, err = img.Parse(u.RawQuery); err != nil {
+		return c, err
+	}
+	vs := u.Query()
+	if c.demosaic, err = img.ParseDemosaic(vs.Get("demosaic")); err != nil {
+		return c, err
+	}
+	if _, ok := vs["roi"]; ok {
+		r, err := img.ParseROI(vs.Get("roi"))
+		if err != nil {
+			return c, err
+		}
+		c.roi = &r
+	}
+	// calibrated is true for the latest version of the calibration or the
+	// version to apply
+	switch v := vs.Get("calibrated"); v {
+	case "", "false":
+	case "true":
+		c.calibrated = true
+	default:
+		c.calibrated, c.calibration = true, v
+	}
+	return c, nil
+}
+
+func readFile(p string) (*file, error) {
 	f, err := os.Open(p)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -243,24 +507,35 @@ func readFile(p string, m time.Time) (*file, error) {
 		return nil, err
 	}
 	defer f.Close()
-	if i, err := f.Stat(); err == nil && (!m.IsZero() && m.Sub(i.ModTime()) <= 0) {
-		return nil, ErrNotModified
-	}
 
 	fs := &file{buf: new(bytes.Buffer)}
+	if p, err := storage.ParseFilename(p); err == nil {
+		fs.origin = p.Origin
+	}
 	binary.Read(f, binary.BigEndian, &fs.fcc)
 	binary.Read(f, binary.BigEndian, &fs.seq)
 	binary.Read(f, binary.BigEndian, &fs.when)
 
 	s := md5.New()
+	binary.Write(s, binary.BigEndian, fs.fcc)
+	binary.Write(s, binary.BigEndian, fs.seq)
+	binary.Write(s, binary.BigEndian, fs.when)
 	if _, err := io.Copy(io.MultiWriter(fs.buf, s), f); err != nil {
 		return nil, err
-	} else {
-		fs.sum = s.Sum(nil)
 	}
+	fs.sum = s.Sum(nil)
 	return fs, nil
 }
 
+func isMetadata(p string) bool {
+	switch filepath.Ext(p) {
+	case ".xml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
 func isAcceptable(a string, vs ...string) bool {
 	if len(vs) == 0 {
 		return true
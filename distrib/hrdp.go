@@ -0,0 +1,58 @@
+package distrib
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/busoc/hadock/storage"
+	"github.com/busoc/panda"
+)
+
+type regenerator struct {
+	catalog string
+}
+
+// Regenerate serves the products found in the catalog in file as HRDP
+// packets, as found in the files of the HRDP archive.
+func Regenerate(file string) (http.Handler, error) {
+	i, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !i.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a file", file)
+	}
+	return regenerator{catalog: file}, nil
+}
+
+func (g regenerator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Starts.IsZero() || q.Ends.IsZero() {
+		http.Error(w, "starts and ends are required", http.StatusBadRequest)
+		return
+	}
+	var c panda.Channel
+	if v := r.URL.Query().Get("channel"); v != "" {
+		var ok bool
+		if c, ok = storage.ParseChannel(v); !ok {
+			http.Error(w, fmt.Sprintf("invalid channel %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	n := fmt.Sprintf("attachment; filename=hdk_%s.dat", q.Starts.UTC().Format("20060102_150405"))
+	w.Header().Set("content-disposition", n)
+	w.Header().Set("content-type", MimeOctet.String())
+
+	ws := &flushWriter{writer: w}
+	if f, ok := w.(http.Flusher); ok {
+		ws.flusher = f
+	}
+	if _, err := storage.Export(ws, g.catalog, q.Query, c); err != nil && !ws.written {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
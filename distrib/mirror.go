@@ -0,0 +1,112 @@
+package distrib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/busoc/hadock/storage"
+)
+
+type receiver struct {
+	datadir string
+	secret  string
+}
+
+// Receive stores in d the products pushed by the mirror shares of hadock.
+// Requests should give secret as bearer token.
+func Receive(d, secret string) (http.Handler, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret required")
+	}
+	i, err := os.Stat(d)
+	if err != nil {
+		return nil, err
+	}
+	if !i.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", d)
+	}
+	return receiver{datadir: d, secret: secret}, nil
+}
+
+func (r receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a := strings.TrimPrefix(req.Header.Get("authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(a), []byte(r.secret)) != 1 {
+		w.Header().Set("www-authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := filepath.Join(r.datadir, filepath.FromSlash(path.Clean("/"+req.URL.Path)))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var want []byte
+	if d := req.Header.Get("digest"); d != "" {
+		if !strings.HasPrefix(strings.ToLower(d), "sha-256=") {
+			http.Error(w, fmt.Sprintf("unsupported digest %s", d), http.StatusBadRequest)
+			return
+		}
+		v, err := base64.StdEncoding.DecodeString(d[8:])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid digest %s", d), http.StatusBadRequest)
+			return
+		}
+		want = v
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, sum), req.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if want != nil && !bytes.Equal(want, sum.Sum(nil)) {
+		os.Remove(f.Name())
+		http.Error(w, "digest mismatch", http.StatusBadRequest)
+		return
+	}
+	os.Chmod(f.Name(), 0644)
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the manifest of the mirror gives the products actually received
+	var (
+		dir  = filepath.Dir(p)
+		base = filepath.Base(p)
+	)
+	if filepath.Ext(p) != storage.BAD && os.Remove(p+storage.BAD) == nil {
+		storage.DropManifest(dir, base+storage.BAD)
+	}
+	manifest := filepath.Join(dir, storage.MANIFEST+"."+storage.SumSHA256)
+	if err := storage.AppendManifest(manifest, base, fmt.Sprintf("%x", sum.Sum(nil))); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
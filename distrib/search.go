@@ -0,0 +1,337 @@
+package distrib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busoc/hadock/catalog"
+	"github.com/busoc/hadock/storage"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 10000
+)
+
+type searcher struct {
+	catalog string
+	rawdir  string
+}
+
+type record struct {
+	Instance uint8     `json:"instance" xml:"instance,attr"`
+	Channel  uint8     `json:"channel" xml:"channel,attr"`
+	Type     string    `json:"type" xml:"type,attr"`
+	Mode     string    `json:"mode" xml:"mode,attr"`
+	Origin   string    `json:"origin" xml:"origin"`
+	UPI      string    `json:"upi,omitempty" xml:"upi,omitempty"`
+	Sequence uint32    `json:"sequence" xml:"sequence"`
+	Format   string    `json:"format" xml:"format"`
+	Size     int64     `json:"size" xml:"size"`
+	Valid    bool      `json:"valid" xml:"valid"`
+	VMU      time.Time `json:"vmu" xml:"vmu"`
+	ACQ      time.Time `json:"acq" xml:"acquisition"`
+	Product  string    `json:"product,omitempty" xml:"links>product,omitempty"`
+	Archive  string    `json:"archive,omitempty" xml:"links>archive,omitempty"`
+}
+
+type search struct {
+	catalog.Query
+
+	Sort   string
+	Desc   bool
+	Limit  int
+	Offset int
+}
+
+func Search(file, rawdir string) (http.Handler, error) {
+	i, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !i.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a file", file)
+	}
+	return searcher{catalog: file, rawdir: rawdir}, nil
+}
+
+func (s searcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	es, more, err := s.search(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rs := make([]record, len(es))
+	for i, e := range es {
+		rs[i] = s.recordOf(e)
+	}
+	if more {
+		u := *r.URL
+		vs := u.Query()
+		vs.Set("offset", strconv.Itoa(q.Offset+q.Limit))
+		u.RawQuery = vs.Encode()
+		w.Header().Set("link", fmt.Sprintf("<%s>; rel=\"next\"", u.String()))
+	}
+
+	ws := new(bytes.Buffer)
+	switch a := r.Header.Get("accept"); {
+	default:
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	case a == "" || isAcceptable(a, "*/*", "application/json"):
+		w.Header().Set("content-type", "application/json")
+		err = json.NewEncoder(ws).Encode(rs)
+	case isAcceptable(a, "application/xml"):
+		w.Header().Set("content-type", "application/xml")
+		v := struct {
+			XMLName xml.Name `xml:"search"`
+			Records []record `xml:"product"`
+		}{Records: rs}
+		err = xml.NewEncoder(ws).Encode(v)
+	case isAcceptable(a, "text/csv"):
+		w.Header().Set("content-type", "text/csv")
+		err = writeRecords(ws, rs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.Copy(w, ws)
+}
+
+// search gives the page of entries selected by q and whether more entries
+// are available. Entries are sorted by acquisition time in the catalog, so
+// only the other orders need all the matching entries to be kept in memory.
+func (s searcher) search(q search) ([]catalog.Entry, bool, error) {
+	var (
+		es      []catalog.Entry
+		natural = (q.Sort == "" || q.Sort == "acq") && !q.Desc
+		skip    = q.Offset
+	)
+	err := catalog.Search(s.catalog, q.Query, func(e catalog.Entry) error {
+		if natural {
+			if skip > 0 {
+				skip--
+				return nil
+			}
+			if len(es) > q.Limit {
+				return catalog.ErrDone
+			}
+		}
+		es = append(es, e)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !natural {
+		less, err := sortBy(es, q.Sort)
+		if err != nil {
+			return nil, false, err
+		}
+		sort.SliceStable(es, func(i, j int) bool {
+			if q.Desc {
+				return less(j, i)
+			}
+			return less(i, j)
+		})
+		if q.Offset >= len(es) {
+			es = es[:0]
+		} else {
+			es = es[q.Offset:]
+		}
+	}
+	if len(es) > q.Limit {
+		return es[:q.Limit], true, nil
+	}
+	return es, false, nil
+}
+
+func (s searcher) recordOf(e catalog.Entry) record {
+	r := record{
+		Instance: e.Instance,
+		Channel:  uint8(e.Channel),
+		Type:     e.Type,
+		Mode:     "playback",
+		Origin:   e.Origin,
+		UPI:      e.UPI,
+		Sequence: e.Sequence,
+		Format:   e.Format,
+		Size:     e.Size,
+		Valid:    e.Valid,
+		VMU:      e.VMU,
+		ACQ:      e.ACQ,
+	}
+	if e.Realtime {
+		r.Mode = "realtime"
+	}
+	for _, l := range e.Locations {
+		if l.Scheme != "file" {
+			continue
+		}
+		rel, err := filepath.Rel(s.rawdir, l.File)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		r.Product = "/products/" + rel
+		r.Archive = "/archives/" + path.Dir(rel) + "?type=tar"
+		break
+	}
+	return r
+}
+
+// fileOf gives the file of the product of e in the archive.
+func fileOf(e catalog.Entry) (string, bool) {
+	for _, l := range e.Locations {
+		if l.Scheme == "file" {
+			return l.File, true
+		}
+	}
+	return "", false
+}
+
+func sortBy(es []catalog.Entry, field string) (func(i, j int) bool, error) {
+	var less func(i, j int) bool
+	switch field {
+	case "acq", "":
+		less = func(i, j int) bool { return es[i].ACQ.Before(es[j].ACQ) }
+	case "vmu":
+		less = func(i, j int) bool { return es[i].VMU.Before(es[j].VMU) }
+	case "sequence":
+		less = func(i, j int) bool { return es[i].Sequence < es[j].Sequence }
+	case "origin":
+		less = func(i, j int) bool { return es[i].Origin < es[j].Origin }
+	case "upi":
+		less = func(i, j int) bool { return es[i].UPI < es[j].UPI }
+	case "size":
+		less = func(i, j int) bool { return es[i].Size < es[j].Size }
+	default:
+		return nil, fmt.Errorf("unknown sort field %s", field)
+	}
+	return less, nil
+}
+
+func writeRecords(w io.Writer, rs []record) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"instance", "channel", "type", "mode", "origin", "upi", "sequence", "format", "size", "valid", "vmu", "acq", "product", "archive"})
+	for _, r := range rs {
+		row := []string{
+			strconv.Itoa(int(r.Instance)),
+			strconv.Itoa(int(r.Channel)),
+			r.Type,
+			r.Mode,
+			r.Origin,
+			r.UPI,
+			strconv.FormatUint(uint64(r.Sequence), 10),
+			r.Format,
+			strconv.FormatInt(r.Size, 10),
+			strconv.FormatBool(r.Valid),
+			r.VMU.Format(time.RFC3339),
+			r.ACQ.Format(time.RFC3339),
+			r.Product,
+			r.Archive,
+		}
+		if err := c.Write(row); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
+}
+
+func parseSearch(r *http.Request) (search, error) {
+	var (
+		q   search
+		err error
+		vs  = r.URL.Query()
+	)
+	q.Instance = -1
+	if v := vs.Get("instance"); v != "" {
+		if i, ok := storage.ParseInstance(v); ok {
+			q.Instance = int(i)
+		} else if q.Instance, err = strconv.Atoi(v); err != nil {
+			return q, fmt.Errorf("invalid instance %s", v)
+		}
+	}
+	if q.Starts, err = parseTime(vs, "starts"); err != nil {
+		return q, err
+	}
+	if q.Ends, err = parseTime(vs, "ends"); err != nil {
+		return q, err
+	}
+	switch q.Time = strings.ToLower(vs.Get("time")); q.Time {
+	case "", "acq", "vmu":
+	default:
+		return q, fmt.Errorf("invalid time %s", q.Time)
+	}
+	switch q.Mode = strings.ToLower(vs.Get("mode")); q.Mode {
+	case "", "realtime", "playback":
+	default:
+		return q, fmt.Errorf("invalid mode %s", q.Mode)
+	}
+	q.Type = vs.Get("type")
+	q.Origin = vs.Get("origin")
+	q.UPI = vs.Get("upi")
+	q.Format = vs.Get("format")
+	if v := vs.Get("valid"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid valid %s", v)
+		}
+		q.Valid = &b
+	}
+
+	q.Sort = strings.ToLower(vs.Get("sort"))
+	if strings.HasPrefix(q.Sort, "-") {
+		q.Sort, q.Desc = q.Sort[1:], true
+	}
+	if _, err := sortBy(nil, q.Sort); err != nil {
+		return q, err
+	}
+	q.Limit, q.Offset = DefaultLimit, 0
+	if v := vs.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("invalid limit %s", v)
+		}
+		if q.Limit > MaxLimit {
+			q.Limit = MaxLimit
+		}
+	}
+	if v := vs.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("invalid offset %s", v)
+		}
+	}
+	return q, nil
+}
+
+func parseTime(vs url.Values, k string) (time.Time, error) {
+	v := vs.Get(k)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s %s", k, v)
+	}
+	return t, nil
+}
@@ -0,0 +1,187 @@
+package distrib
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/busoc/hadock/catalog"
+	img "github.com/busoc/hadock/internal/image"
+)
+
+const (
+	DefaultFPS = 5
+	MaxFPS     = 60
+	MaxFrames  = 1000
+)
+
+const (
+	MimeAVI = Mime("video/x-msvideo")
+	MimeZip = Mime("application/zip")
+)
+
+type sequencer struct {
+	catalog string
+}
+
+// Sequence serves the image products of an origin found in the catalog in
+// file as an animated GIF, a MJPEG video or a zip of PNG files.
+func Sequence(file string) (http.Handler, error) {
+	i, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !i.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a file", file)
+	}
+	return sequencer{catalog: file}, nil
+}
+
+func (s sequencer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Origin == "" || q.Starts.IsZero() || q.Ends.IsZero() {
+		http.Error(w, "origin, starts and ends are required", http.StatusBadRequest)
+		return
+	}
+	q.Type = "images"
+
+	vs := r.URL.Query()
+	fps, every := DefaultFPS, 1
+	if v := vs.Get("fps"); v != "" {
+		if fps, err = strconv.Atoi(v); err != nil || fps <= 0 || fps > MaxFPS {
+			http.Error(w, fmt.Sprintf("invalid fps %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := vs.Get("every"); v != "" {
+		if every, err = strconv.Atoi(v); err != nil || every <= 0 {
+			http.Error(w, fmt.Sprintf("invalid every %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	// timestamp without a value is set
+	_, stamp := vs["timestamp"]
+	if v := vs.Get("timestamp"); v != "" {
+		if stamp, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid timestamp %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var mime Mime
+	// output selects the container of the frames
+	switch f := vs.Get("output"); f {
+	case "gif":
+		mime = MimeGif
+	case "avi":
+		mime = MimeAVI
+	case "zip":
+		mime = MimeZip
+	case "":
+		a := r.Header.Get("accept")
+		m, ok := accept(a, []Mime{MimeGif, MimeAVI, MimeZip})
+		switch {
+		case ok:
+			mime = m
+		case a == "" || isAcceptable(a, "*/*"):
+			mime = MimeGif
+		default:
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("invalid output %s", f), http.StatusBadRequest)
+		return
+	}
+	c, err := parseConversion(r.URL, MimePNG)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	es, err := s.frames(q.Query, every)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case len(es) == 0:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case len(es) > MaxFrames:
+		http.Error(w, fmt.Sprintf("more than %d frames, increase every", MaxFrames), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("content-type", mime.String())
+	ws := &flushWriter{writer: w}
+	if f, ok := w.(http.Flusher); ok {
+		ws.flusher = f
+	}
+	ss, _ := img.NewSequence(ws, mime.SubType(), fps)
+	var n int
+	for _, e := range es {
+		i, err := s.convert(e, c, stamp)
+		if err != nil {
+			log.Printf("sequence: %s/%d: %s", e.Origin, e.Sequence, err)
+			continue
+		}
+		if err := ss.Add(i); err != nil {
+			log.Printf("sequence: %s/%d: %s", e.Origin, e.Sequence, err)
+			return
+		}
+		n++
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := ss.Close(); err != nil && !ws.written {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// frames gives the entries selected by q keeping one entry every n entries.
+func (s sequencer) frames(q catalog.Query, n int) ([]catalog.Entry, error) {
+	es, err := catalog.Collect(s.catalog, q, (MaxFrames+1)*n)
+	if err != nil {
+		return nil, err
+	}
+	var fs []catalog.Entry
+	for i := 0; i < len(es) && len(fs) <= MaxFrames; i += n {
+		fs = append(fs, es[i])
+	}
+	return fs, nil
+}
+
+func (s sequencer) convert(e catalog.Entry, c conversion, stamp bool) (image.Image, error) {
+	p, ok := fileOf(e)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	f, err := readFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if c.roi != nil {
+		r := *c.roi
+		r.Geometry = geometryOf(readSidecar(p))
+		c.roi = &r
+	}
+	i, err := f.Convert(c)
+	if err != nil {
+		return nil, err
+	}
+	if stamp {
+		i = img.Label(e.ACQ.UTC().Format(time.RFC3339Nano)).Transform(i)
+	}
+	return i, nil
+}
@@ -0,0 +1,188 @@
+package distrib
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/busoc/hadock/catalog"
+	"github.com/busoc/hadock/internal/science"
+)
+
+const DefaultGap = 5 * time.Second
+
+type serier struct {
+	catalog      string
+	schemas      science.Schemas
+	calibrations science.Calibrations
+}
+
+// Series serves the records of the science products of an origin found in
+// the catalog in file merged in a single series. Products are decoded with
+// the builtin schemas and the ones found in s and calibrated with the
+// calibrations found in k.
+func Series(file, s, k string) (http.Handler, error) {
+	i, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !i.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a file", file)
+	}
+	x := serier{catalog: file}
+	if x.schemas, err = science.Load(s); err != nil {
+		return nil, err
+	}
+	if x.calibrations, err = science.LoadCalibrations(k); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (s serier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Origin == "" || q.Starts.IsZero() || q.Ends.IsZero() {
+		http.Error(w, "origin, starts and ends are required", http.StatusBadRequest)
+		return
+	}
+	q.Type = "sciences"
+
+	vs := r.URL.Query()
+	gap := DefaultGap
+	if v := vs.Get("gap"); v != "" {
+		if gap, err = time.ParseDuration(v); err != nil || gap <= 0 {
+			http.Error(w, fmt.Sprintf("invalid gap %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	var calibrated bool
+	version := vs.Get("calibrated")
+	switch version {
+	case "", "false":
+	case "true":
+		calibrated, version = true, ""
+	default:
+		calibrated = true
+	}
+
+	ws := &flushWriter{writer: w}
+	if f, ok := w.(http.Flusher); ok {
+		ws.flusher = f
+	}
+	var ss science.Series
+	switch a := r.Header.Get("accept"); {
+	default:
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	case a == "" || isAcceptable(a, "*/*", MimeCSV.String()):
+		w.Header().Set("content-type", MimeCSV.String())
+		ss = science.NewCSVSeries(ws)
+	case isAcceptable(a, MimeNDJSON.String()):
+		w.Header().Set("content-type", MimeNDJSON.String())
+		ss = science.NewJSONSeries(ws, false)
+	case isAcceptable(a, MimeJSON.String()):
+		w.Header().Set("content-type", MimeJSON.String())
+		ss = science.NewJSONSeries(ws, true)
+	}
+
+	es, err := s.entries(q.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var (
+		prev time.Time
+		t    *science.Table
+	)
+	for _, e := range es {
+		if t, err = s.decode(e, calibrated, version); err != nil {
+			if err == ErrNoCalibration && !ws.written {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Printf("series: %s/%d: %s", e.Origin, e.Sequence, err)
+			err = nil
+			continue
+		}
+		if !prev.IsZero() && t.Time.Sub(prev) > gap {
+			if err = ss.Gap(prev, t.Time); err != nil {
+				break
+			}
+		}
+		switch err = ss.Write(t); err {
+		case nil:
+			prev = t.Time
+		case science.ErrColumns:
+			log.Printf("series: %s/%d: %s", e.Origin, e.Sequence, err)
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = ss.Close()
+	}
+	if err != nil && !ws.written {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// entries gives the entries of the products selected by q. Entries are
+// collected before the products are read to release the catalog.
+func (s serier) entries(q catalog.Query) ([]catalog.Entry, error) {
+	return catalog.Collect(s.catalog, q, 0)
+}
+
+// decode gives the records of the product of e.
+func (s serier) decode(e catalog.Entry, calibrated bool, version string) (*science.Table, error) {
+	p, ok := fileOf(e)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	f, err := readFile(p)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := s.schemas.Lookup(f.FCC(), e.Origin)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	t, err := c.Decode(f.buf.Bytes(), f.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	if calibrated {
+		k, ok := s.calibrations.Find(f.FCC(), e.Origin, f.ModTime(), version)
+		if !ok {
+			return nil, ErrNoCalibration
+		}
+		k.Apply(t)
+	}
+	return t, nil
+}
+
+// flushWriter sends the data written to the client immediately.
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+	written bool
+}
+
+func (w *flushWriter) Write(bs []byte) (int, error) {
+	n, err := w.writer.Write(bs)
+	if n > 0 {
+		w.written = true
+	}
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
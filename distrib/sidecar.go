@@ -0,0 +1,144 @@
+package distrib
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	img "github.com/busoc/hadock/internal/image"
+)
+
+// readSidecar gives the values found in the sidecar of the product p as FITS
+// cards. The names of nested elements are joined with a dot and the name of
+// the root element is dropped.
+func readSidecar(p string) []img.Card {
+	if r, err := os.Open(p + ".xml"); err == nil {
+		defer r.Close()
+		return xmlCards(r)
+	}
+	if r, err := os.Open(p + ".json"); err == nil {
+		defer r.Close()
+		return jsonCards(r)
+	}
+	return nil
+}
+
+func xmlCards(r io.Reader) []img.Card {
+	var (
+		cs   []img.Card
+		path []string
+		d    = xml.NewDecoder(r)
+	)
+	key := func(n string) string {
+		ps := append(path[1:len(path):len(path)], n)
+		return strings.Join(ps, ".")
+	}
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			for _, a := range t.Attr {
+				cs = append(cs, img.Card{Key: key(a.Name.Local), Value: a.Value})
+			}
+		case xml.EndElement:
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+		case xml.CharData:
+			v := strings.TrimSpace(string(t))
+			if v == "" || len(path) < 2 {
+				continue
+			}
+			cs = append(cs, img.Card{Key: strings.Join(path[1:], "."), Value: v})
+		}
+	}
+	return cs
+}
+
+func jsonCards(r io.Reader) []img.Card {
+	var v map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil
+	}
+	return flatten("", v, nil)
+}
+
+func flatten(prefix string, v interface{}, cs []img.Card) []img.Card {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		ks := make([]string, 0, len(v))
+		for k := range v {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+		for _, k := range ks {
+			n := k
+			if prefix != "" {
+				n = prefix + "." + k
+			}
+			cs = flatten(n, v[k], cs)
+		}
+	case []interface{}:
+		for _, x := range v {
+			cs = flatten(prefix, x, cs)
+		}
+	case nil:
+	default:
+		cs = append(cs, img.Card{Key: prefix, Value: v})
+	}
+	return cs
+}
+
+// geometryOf gives the size of the sensor and the region of interest found in
+// the IDH of a sidecar. Both the names of the fields of the IDH and the names
+// used by the svs plugin are recognized.
+func geometryOf(cs []img.Card) img.Geometry {
+	var (
+		g      img.Geometry
+		x, y   int
+		sx, sy int
+	)
+	for _, c := range cs {
+		v, err := strconv.Atoi(fmt.Sprint(c.Value))
+		if err != nil {
+			continue
+		}
+		switch k := strings.ToLower(c.Key); {
+		case hasField(k, "pixels.x", "source-x-size"):
+			g.Sensor.X = v
+		case hasField(k, "pixels.y", "source-y-size"):
+			g.Sensor.Y = v
+		case hasField(k, "region.offsetx", "roi-x-offset"):
+			x = v
+		case hasField(k, "region.offsety", "roi-y-offset"):
+			y = v
+		case hasField(k, "region.sizex", "roi-x-size"):
+			sx = v
+		case hasField(k, "region.sizey", "roi-y-size"):
+			sy = v
+		}
+	}
+	if sx > 0 && sy > 0 {
+		g.Region = image.Rect(x, y, x+sx, y+sy)
+	}
+	return g
+}
+
+func hasField(k string, ns ...string) bool {
+	for _, n := range ns {
+		if k == n || strings.HasSuffix(k, "."+n) {
+			return true
+		}
+	}
+	return false
+}
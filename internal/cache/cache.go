@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps files in a directory up to a maximum size. When the limit is
+// reached, the files that have not been used for the longest time are removed
+// first. Multiple processes can share the same directory.
+type Cache struct {
+	dir string
+	max int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+// DefaultSize is the maximum size of a cache when none is given.
+const DefaultSize = 1 << 30
+
+func New(dir string, max int64) (*Cache, error) {
+	switch {
+	case max == 0:
+		max = DefaultSize
+	case max < 0:
+		return nil, fmt.Errorf("invalid cache size %d", max)
+	}
+	i, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !i.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", dir)
+	}
+	c := Cache{dir: dir, max: max}
+	fs, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		c.size += f.size
+	}
+	return &c, nil
+}
+
+func Key(parts ...string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(parts, "\x00"))))
+}
+
+// Get opens the file cached under k. The caller should close it.
+func (c *Cache) Get(k string) (*os.File, bool) {
+	p := c.path(k)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return f, true
+}
+
+func (c *Cache) Put(k string, bs []byte) error {
+	p := c.path(k)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size += int64(len(bs)); c.size > c.max {
+		return c.evict()
+	}
+	return nil
+}
+
+// evict removes the oldest files until the cache is back under 90% of its
+// limit. The actual size is computed again since other processes could have
+// added or removed files.
+func (c *Cache) evict() error {
+	fs, err := c.files()
+	if err != nil {
+		return err
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].mod.Before(fs[j].mod) })
+
+	c.size = 0
+	for _, f := range fs {
+		c.size += f.size
+	}
+	limit := c.max - c.max/10
+	for _, f := range fs {
+		if c.size <= limit {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		c.size -= f.size
+	}
+	return nil
+}
+
+func (c *Cache) path(k string) string {
+	return filepath.Join(c.dir, k[:2], k)
+}
+
+type entry struct {
+	path string
+	size int64
+	mod  time.Time
+}
+
+func (c *Cache) files() ([]entry, error) {
+	var es []entry
+	err := filepath.Walk(c.dir, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !i.Mode().IsRegular() || strings.HasPrefix(i.Name(), ".") {
+			return nil
+		}
+		es = append(es, entry{path: p, size: i.Size(), mod: i.ModTime()})
+		return nil
+	})
+	return es, err
+}
@@ -0,0 +1,266 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	fitsBlock = 2880
+	fitsCard  = 80
+)
+
+// Card is a keyword of a FITS header. Keywords longer than 8 characters or
+// with characters not allowed by the standard are written with the HIERARCH
+// convention.
+type Card struct {
+	Key     string
+	Value   interface{}
+	Comment string
+}
+
+// String gives the card on at most 80 characters. Strings are shortened to
+// keep their closing quote and comments are truncated first.
+func (c Card) String() string {
+	k := strings.ToUpper(c.Key)
+	prefix := fmt.Sprintf("%-8s= ", k)
+	if !isStandardKey(k) {
+		prefix = fmt.Sprintf("HIERARCH %s = ", k)
+	}
+	var v string
+	switch x := c.Value.(type) {
+	case bool:
+		v = "F"
+		if x {
+			v = "T"
+		}
+	case int, int64, uint8, uint16, uint32, int32, int16:
+		v = fmt.Sprintf("%d", x)
+	case float64:
+		v = strconv.FormatFloat(x, 'G', -1, 64)
+	case string:
+		if _, err := strconv.ParseFloat(x, 64); err == nil {
+			v = x
+		} else {
+			v = quoteCard(x, fitsCard-len(prefix))
+		}
+	default:
+		v = quoteCard(fmt.Sprint(x), fitsCard-len(prefix))
+	}
+	// fixed format: numbers and logicals end in column 30
+	if v[0] != '\'' && isStandardKey(k) {
+		v = fmt.Sprintf("%20s", v)
+	}
+	s := prefix + v
+	if c.Comment != "" {
+		s += " / " + c.Comment
+	}
+	if len(s) > fitsCard {
+		s = s[:fitsCard]
+	}
+	return s
+}
+
+// quoteCard quotes s on at most n characters. Quotes of s are doubled and
+// characters not allowed in a header are replaced by '?'.
+func quoteCard(s string, n int) string {
+	var b bytes.Buffer
+	b.WriteByte('\'')
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			r = '?'
+		}
+		w := 1
+		if r == '\'' {
+			w = 2
+		}
+		if b.Len()+w+1 > n {
+			break
+		}
+		if r == '\'' {
+			b.WriteString("''")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+func isStandardKey(k string) bool {
+	if len(k) > 8 {
+		return false
+	}
+	for _, r := range k {
+		if !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeFITS writes i as the primary HDU of a FITS file. Gray images keep
+// their depth (16 bits images are written as signed integers with BZERO set to
+// 32768), colour images are written as 3 planes of 8 bits. Rows are written
+// from the bottom of the image as expected by FITS viewers.
+func EncodeFITS(w io.Writer, i image.Image, cards []Card) error {
+	b := i.Bounds()
+	var (
+		hs     []Card
+		bitpix = 8
+		planes = 1
+	)
+	switch i.(type) {
+	case *image.Gray:
+	case *image.Gray16:
+		bitpix = 16
+	default:
+		planes = 3
+	}
+	hs = append(hs, Card{Key: "SIMPLE", Value: true}, Card{Key: "BITPIX", Value: bitpix})
+	if planes > 1 {
+		hs = append(hs, Card{Key: "NAXIS", Value: 3})
+	} else {
+		hs = append(hs, Card{Key: "NAXIS", Value: 2})
+	}
+	hs = append(hs, Card{Key: "NAXIS1", Value: b.Dx()}, Card{Key: "NAXIS2", Value: b.Dy()})
+	if planes > 1 {
+		hs = append(hs, Card{Key: "NAXIS3", Value: planes})
+	}
+	if bitpix == 16 {
+		hs = append(hs, Card{Key: "BZERO", Value: 32768}, Card{Key: "BSCALE", Value: 1})
+	}
+	hs = append(hs, cards...)
+
+	var head bytes.Buffer
+	for _, c := range hs {
+		fmt.Fprintf(&head, "%-80s", c.String())
+	}
+	fmt.Fprintf(&head, "%-80s", "END")
+	if n := head.Len() % fitsBlock; n > 0 {
+		head.Write(bytes.Repeat([]byte(" "), fitsBlock-n))
+	}
+	if _, err := head.WriteTo(w); err != nil {
+		return err
+	}
+
+	var (
+		ws   = bufio.NewWriter(w)
+		row  = make([]byte, b.Dx()*bitpix/8)
+		size int
+	)
+	for p := 0; p < planes; p++ {
+		for y := b.Max.Y - 1; y >= b.Min.Y; y-- {
+			n, _ := ws.Write(fitsRow(row, i, y, p))
+			size += n
+		}
+	}
+	if n := size % fitsBlock; n > 0 {
+		ws.Write(make([]byte, fitsBlock-n))
+	}
+	return ws.Flush()
+}
+
+// EncodeNPY writes the pixels of i as a NumPy array (version 1.0 of the
+// format). The shape of the array is (height, width) for gray images and
+// (height, width, 3) for colour images.
+func EncodeNPY(w io.Writer, i image.Image) error {
+	b := i.Bounds()
+	var (
+		descr = "|u1"
+		shape = fmt.Sprintf("(%d, %d)", b.Dy(), b.Dx())
+	)
+	switch i.(type) {
+	case *image.Gray:
+	case *image.Gray16:
+		descr = "<u2"
+	default:
+		shape = fmt.Sprintf("(%d, %d, 3)", b.Dy(), b.Dx())
+	}
+	head := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': %s, }", descr, shape)
+	// magic (6), version (2) and length of the header (2) are included in the
+	// alignment of the header on 64 bytes
+	if n := (10 + len(head) + 1) % 64; n > 0 {
+		head += strings.Repeat(" ", 64-n)
+	}
+	head += "\n"
+
+	ws := bufio.NewWriter(w)
+	ws.WriteString("\x93NUMPY")
+	ws.Write([]byte{1, 0})
+	binary.Write(ws, binary.LittleEndian, uint16(len(head)))
+	ws.WriteString(head)
+
+	row := make([]byte, b.Dx()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		ws.Write(npyRow(row, i, y))
+	}
+	return ws.Flush()
+}
+
+// fitsRow gives the values of the plane p of the row y of i as written in a
+// FITS file. The pixels of gray images are given as is (16 bits pixels are
+// offset by BZERO) and colour images give the plane p of their pixels.
+func fitsRow(row []byte, i image.Image, y, p int) []byte {
+	b := i.Bounds()
+	switch i := i.(type) {
+	case *image.Gray:
+		ix := i.PixOffset(b.Min.X, y)
+		return i.Pix[ix : ix+b.Dx()]
+	case *image.Gray16:
+		ix := i.PixOffset(b.Min.X, y)
+		copy(row, i.Pix[ix:ix+2*b.Dx()])
+		for j := 0; j < len(row); j += 2 {
+			row[j] ^= 0x80
+		}
+		return row
+	case *image.RGBA:
+		ix := i.PixOffset(b.Min.X, y) + p
+		for j := range row {
+			row[j] = i.Pix[ix+4*j]
+		}
+		return row
+	default:
+		for j := range row {
+			r, g, b, _ := i.At(b.Min.X+j, y).RGBA()
+			row[j] = uint8([]uint32{r, g, b}[p] >> 8)
+		}
+		return row
+	}
+}
+
+// npyRow gives the values of the row y of i as written in a NumPy array.
+func npyRow(row []byte, i image.Image, y int) []byte {
+	b := i.Bounds()
+	switch i := i.(type) {
+	case *image.Gray:
+		ix := i.PixOffset(b.Min.X, y)
+		return i.Pix[ix : ix+b.Dx()]
+	case *image.Gray16:
+		ix := i.PixOffset(b.Min.X, y)
+		row = row[:2*b.Dx()]
+		for j := 0; j < len(row); j += 2 {
+			row[j], row[j+1] = i.Pix[ix+j+1], i.Pix[ix+j]
+		}
+		return row
+	case *image.RGBA:
+		ix := i.PixOffset(b.Min.X, y)
+		for j := 0; j < len(row); j += 3 {
+			copy(row[j:j+3], i.Pix[ix:ix+3])
+			ix += 4
+		}
+		return row
+	default:
+		for j := 0; j < len(row); j += 3 {
+			r, g, b, _ := i.At(b.Min.X+j/3, y).RGBA()
+			row[j], row[j+1], row[j+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+		}
+		return row
+	}
+}
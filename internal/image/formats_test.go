@@ -0,0 +1,259 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	formats := []struct {
+		Name   string
+		Decode func([]byte) (image.Image, error)
+	}{
+		{Name: "fits", Decode: readFITS},
+		{Name: "npy", Decode: readNPY},
+		{Name: "png", Decode: func(bs []byte) (image.Image, error) { return png.Decode(bytes.NewReader(bs)) }},
+		{Name: "tiff", Decode: func(bs []byte) (image.Image, error) { return tiff.Decode(bytes.NewReader(bs)) }},
+	}
+	const x, y = 5, 3
+	images := []struct {
+		Name   string
+		Decode func() (image.Image, error)
+	}{
+		{Name: "gray", Decode: func() (image.Image, error) { return ImageGray8(x, y, pattern(x*y)) }},
+		{Name: "gray16", Decode: func() (image.Image, error) { return ImageGray16(x, y, pattern(x*y*2), binary.BigEndian) }},
+		{Name: "rgba", Decode: func() (image.Image, error) { return ImageRGB(x, y, pattern(x*y*3)) }},
+		{Name: "sub", Decode: func() (image.Image, error) {
+			i, err := ImageGray16(x+2, y+2, pattern((x+2)*(y+2)*2), binary.BigEndian)
+			if err != nil {
+				return nil, err
+			}
+			return i.(*image.Gray16).SubImage(image.Rect(1, 1, x+1, y+1)), nil
+		}},
+		{Name: "nrgba", Decode: func() (image.Image, error) {
+			i := image.NewNRGBA(image.Rect(0, 0, x, y))
+			copy(i.Pix, pattern(len(i.Pix)))
+			for j := 3; j < len(i.Pix); j += 4 {
+				i.Pix[j] = 0xFF
+			}
+			return i, nil
+		}},
+	}
+	for _, i := range images {
+		want, err := i.Decode()
+		if err != nil {
+			t.Fatalf("%s: %s", i.Name, err)
+		}
+		for _, f := range formats {
+			var w bytes.Buffer
+			if err := Encode(&w, want, f.Name); err != nil {
+				t.Errorf("%s/%s: encoding failed: %s", i.Name, f.Name, err)
+				continue
+			}
+			got, err := f.Decode(w.Bytes())
+			if err != nil {
+				t.Errorf("%s/%s: decoding failed: %s", i.Name, f.Name, err)
+				continue
+			}
+			if err := samePixels(want, got); err != nil {
+				t.Errorf("%s/%s: %s", i.Name, f.Name, err)
+			}
+		}
+	}
+}
+
+func TestCardString(t *testing.T) {
+	long := strings.Repeat("it's a long value ", 8)
+	data := []Card{
+		{Key: "BITPIX", Value: 16, Comment: "bits per pixel"},
+		{Key: "ORIGIN", Value: long},
+		{Key: "ORIGIN", Value: "hadock", Comment: long},
+		{Key: "HRD.SOURCE.INFO", Value: long, Comment: "source"},
+		{Key: "OBJECT", Value: strings.Repeat("'", 50)},
+	}
+	for _, c := range data {
+		s := c.String()
+		if len(s) > fitsCard {
+			t.Errorf("%s: card too long (%d): %s", c.Key, len(s), s)
+		}
+		if _, ok := c.Value.(string); !ok {
+			continue
+		}
+		v := s[strings.Index(s, "=")+1:]
+		if ix := strings.Index(v, "'"); ix < 0 || !closedString(v[ix:]) {
+			t.Errorf("%s: unterminated string: %s", c.Key, s)
+		}
+	}
+}
+
+// closedString tells if the quoted string at the start of v is terminated.
+func closedString(v string) bool {
+	for i := 1; i < len(v); i++ {
+		if v[i] != '\'' {
+			continue
+		}
+		if i+1 < len(v) && v[i+1] == '\'' {
+			i++
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func pattern(n int) []byte {
+	bs := make([]byte, n)
+	for i := range bs {
+		bs[i] = byte(i*37 + i/7)
+	}
+	return bs
+}
+
+func samePixels(want, got image.Image) error {
+	if want.Bounds().Size() != got.Bounds().Size() {
+		return fmt.Errorf("size mismatch: want %s, got %s", want.Bounds().Size(), got.Bounds().Size())
+	}
+	w, g := want.Bounds(), got.Bounds()
+	for y := 0; y < w.Dy(); y++ {
+		for x := 0; x < w.Dx(); x++ {
+			r0, g0, b0, a0 := want.At(w.Min.X+x, w.Min.Y+y).RGBA()
+			r1, g1, b1, a1 := got.At(g.Min.X+x, g.Min.Y+y).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+				return fmt.Errorf("pixel (%d,%d): want %04x%04x%04x%04x, got %04x%04x%04x%04x", x, y, r0, g0, b0, a0, r1, g1, b1, a1)
+			}
+		}
+	}
+	return nil
+}
+
+// readFITS decodes the primary HDU written by EncodeFITS.
+func readFITS(bs []byte) (image.Image, error) {
+	if len(bs)%fitsBlock != 0 {
+		return nil, fmt.Errorf("length not a multiple of %d: %d", fitsBlock, len(bs))
+	}
+	hs := make(map[string]string)
+	var offset int
+	for {
+		if offset+fitsCard > len(bs) {
+			return nil, fmt.Errorf("END not found")
+		}
+		c := string(bs[offset : offset+fitsCard])
+		offset += fitsCard
+		if strings.TrimSpace(c) == "END" {
+			break
+		}
+		if c[8:10] == "= " {
+			v := c[10:]
+			if ix := strings.Index(v, "/"); ix >= 0 && !strings.HasPrefix(strings.TrimSpace(v), "'") {
+				v = v[:ix]
+			}
+			hs[strings.TrimSpace(c[:8])] = strings.TrimSpace(v)
+		}
+	}
+	if n := offset % fitsBlock; n > 0 {
+		offset += fitsBlock - n
+	}
+	if hs["SIMPLE"] != "T" {
+		return nil, fmt.Errorf("SIMPLE not set")
+	}
+	var (
+		bitpix = atoi(hs["BITPIX"])
+		x      = atoi(hs["NAXIS1"])
+		y      = atoi(hs["NAXIS2"])
+		planes = 1
+		data   = bs[offset:]
+	)
+	if hs["NAXIS"] == "3" {
+		planes = atoi(hs["NAXIS3"])
+	}
+	if len(data) < x*y*planes*bitpix/8 {
+		return nil, fmt.Errorf("short data: %d bytes", len(data))
+	}
+	// rows are written from the bottom
+	switch {
+	case bitpix == 16:
+		zero := atoi(hs["BZERO"])
+		g := image.NewGray16(image.Rect(0, 0, x, y))
+		for i := 0; i < x*y; i++ {
+			v := int(int16(binary.BigEndian.Uint16(data[2*i:]))) + zero
+			k := ((y-1-i/x)*x + i%x) * 2
+			g.Pix[k], g.Pix[k+1] = uint8(v>>8), uint8(v)
+		}
+		return g, nil
+	case bitpix == 8 && planes == 1:
+		g := image.NewGray(image.Rect(0, 0, x, y))
+		for i := 0; i < x*y; i++ {
+			g.Pix[(y-1-i/x)*x+i%x] = data[i]
+		}
+		return g, nil
+	case bitpix == 8 && planes == 3:
+		g := image.NewRGBA(image.Rect(0, 0, x, y))
+		for p := 0; p < planes; p++ {
+			for i := 0; i < x*y; i++ {
+				g.Pix[((y-1-i/x)*x+i%x)*4+p] = data[p*x*y+i]
+			}
+		}
+		for i := 3; i < len(g.Pix); i += 4 {
+			g.Pix[i] = 0xFF
+		}
+		return g, nil
+	default:
+		return nil, fmt.Errorf("unsupported BITPIX %d with %d planes", bitpix, planes)
+	}
+}
+
+var npyHeader = regexp.MustCompile(`^\{'descr': '([<|]u[12])', 'fortran_order': False, 'shape': \((\d+), (\d+)(, 3)?\), \} *\n$`)
+
+// readNPY decodes the arrays written by EncodeNPY.
+func readNPY(bs []byte) (image.Image, error) {
+	if len(bs) < 10 || string(bs[:6]) != "\x93NUMPY" || bs[6] != 1 || bs[7] != 0 {
+		return nil, fmt.Errorf("invalid magic")
+	}
+	n := int(binary.LittleEndian.Uint16(bs[8:]))
+	if (10+n)%64 != 0 {
+		return nil, fmt.Errorf("header not aligned: %d", 10+n)
+	}
+	if len(bs) < 10+n {
+		return nil, fmt.Errorf("short header")
+	}
+	ms := npyHeader.FindStringSubmatch(string(bs[10 : 10+n]))
+	if ms == nil {
+		return nil, fmt.Errorf("invalid header: %q", bs[10:10+n])
+	}
+	var (
+		y    = atoi(ms[2])
+		x    = atoi(ms[3])
+		data = bs[10+n:]
+	)
+	switch {
+	case ms[1] == "<u2":
+		if len(data) != x*y*2 {
+			return nil, fmt.Errorf("data length mismatch: %d", len(data))
+		}
+		return ImageGray16(x, y, data, binary.LittleEndian)
+	case ms[4] != "":
+		if len(data) != x*y*3 {
+			return nil, fmt.Errorf("data length mismatch: %d", len(data))
+		}
+		return ImageRGB(x, y, data)
+	default:
+		if len(data) != x*y {
+			return nil, fmt.Errorf("data length mismatch: %d", len(data))
+		}
+		return ImageGray8(x, y, data)
+	}
+}
+
+func atoi(v string) int {
+	n, _ := strconv.Atoi(v)
+	return n
+}
@@ -3,78 +3,213 @@ package image
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"image"
-	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/busoc/panda"
+	"golang.org/x/image/tiff"
 )
 
-func ImageRGB(x, y int, points []byte) image.Image {
-	g := image.NewRGBA(image.Rect(0, 0, x, y))
-	buf := bytes.NewBuffer(points)
-	for i := 0; i < y; i++ {
-		for j := 0; j < x; j++ {
-			var red, green, blue uint8
-			binary.Read(buf, binary.BigEndian, &red)
-			binary.Read(buf, binary.BigEndian, &green)
-			binary.Read(buf, binary.BigEndian, &blue)
-
-			g.Set(j, i, color.RGBA{R: red, G: green, B: blue, A: 255})
-		}
-	}
-	return g
+var (
+	YUYV = []byte("YUYV")
+	UYVY = []byte("UYVY")
+)
+
+// Decode gives the image of a x by y frame whose pixels are encoded in bs
+// according to fcc. Bayer mosaics are rebuilt with bilinear interpolation.
+func Decode(fcc uint32, x, y int, bs []byte) (image.Image, error) {
+	return DecodeWith(fcc, x, y, bs, Bilinear)
 }
 
-func ImageLBR(x, y int, points []byte) image.Image {
-	g := image.NewYCbCr(image.Rect(0, 0, x, y), image.YCbCrSubsampleRatio422)
+// DecodeWith is like Decode but rebuilds Bayer mosaics with the given method.
+func DecodeWith(fcc uint32, x, y int, bs []byte, d Demosaic) (image.Image, error) {
+	cc := make([]byte, 4)
+	binary.BigEndian.PutUint32(cc, fcc)
+	switch {
+	case bytes.Equal(cc, panda.JPEG) || bytes.Equal(cc, panda.PNG):
+		i, _, err := image.Decode(bytes.NewReader(bs))
+		return i, err
+	case bytes.Equal(cc, panda.YUY2) || bytes.Equal(cc, YUYV):
+		return ImageYUYV(x, y, bs)
+	case bytes.Equal(cc, UYVY):
+		return ImageUYVY(x, y, bs)
+	case bytes.Equal(cc, panda.Y800):
+		return ImageGray8(x, y, bs)
+	case bytes.Equal(cc, panda.I420):
+		return ImageI420(x, y, bs)
+	case bytes.Equal(cc, panda.RGB):
+		return ImageRGB(x, y, bs)
+	case bytes.Equal(cc, panda.Y16B):
+		return ImageGray16(x, y, bs, binary.BigEndian)
+	case bytes.Equal(cc, panda.Y16L):
+		return ImageGray16(x, y, bs, binary.LittleEndian)
+	case bytes.Equal(cc, RGGB) || bytes.Equal(cc, BGGR) || bytes.Equal(cc, GRBG) || bytes.Equal(cc, GBRG):
+		return ImageBayer(x, y, bs, string(cc), d)
+	case bytes.Equal(cc, Y10P):
+		return ImageY10P(x, y, bs)
+	case bytes.Equal(cc, Y12P):
+		return ImageY12P(x, y, bs)
+	default:
+		return nil, fmt.Errorf("not supported %x", fcc)
+	}
+}
 
-	ls := make([]byte, 0, len(points)/2)
-	bs := make([]byte, 0, len(points)/4)
-	rs := make([]byte, 0, len(points)/4)
+// IsImage tells if fcc is the FourCC of an image product.
+func IsImage(fcc []byte) bool {
+	if bytes.Equal(fcc, panda.JPEG) || bytes.Equal(fcc, panda.PNG) {
+		return true
+	}
+	_, ok := FrameSize(fcc, 0, 0)
+	return ok
+}
 
-	for i := 0; i < len(points); i += 4 {
-		ls = append(ls, points[i], points[i+2])
-		bs = append(rs, points[i+1])
-		rs = append(rs, points[i+3])
+// FrameSize gives the number of bytes of a x by y frame whose pixels are
+// encoded according to fcc. It is false for compressed and unknown formats.
+func FrameSize(fcc []byte, x, y int) (int, bool) {
+	z := x * y
+	switch {
+	case bytes.Equal(fcc, panda.Y800):
+		return z, true
+	case bytes.Equal(fcc, RGGB) || bytes.Equal(fcc, BGGR) || bytes.Equal(fcc, GRBG) || bytes.Equal(fcc, GBRG):
+		return z, true
+	case bytes.Equal(fcc, panda.Y16B) || bytes.Equal(fcc, panda.Y16L):
+		return z * 2, true
+	case bytes.Equal(fcc, panda.YUY2) || bytes.Equal(fcc, YUYV) || bytes.Equal(fcc, UYVY):
+		return z * 2, true
+	case bytes.Equal(fcc, panda.RGB):
+		return z * 3, true
+	case bytes.Equal(fcc, panda.I420):
+		return z + 2*((x+1)/2)*((y+1)/2), true
+	case bytes.Equal(fcc, Y10P):
+		return (z + 3) / 4 * 5, true
+	case bytes.Equal(fcc, Y12P):
+		return (z + 1) / 2 * 3, true
+	default:
+		return 0, false
 	}
-	copy(g.Y, ls)
-	copy(g.Cb, bs)
-	copy(g.Cr, rs)
+}
 
-	return g
+// Encode writes i in the given format (jpeg, png, gif, tiff, fits or npy).
+// PNG is used when the format is unknown. PNG, TIFF, FITS and NPY keep the 16
+// bits of gray images.
+func Encode(w io.Writer, i image.Image, format string) error {
+	switch format {
+	case "jpg", "jpeg":
+		return jpeg.Encode(w, i, &jpeg.Options{Quality: 100})
+	case "gif":
+		return gif.Encode(w, i, new(gif.Options))
+	case "tiff", "tif":
+		return tiff.Encode(w, i, &tiff.Options{Compression: tiff.Deflate})
+	case "fits":
+		return EncodeFITS(w, i, nil)
+	case "npy", "x-npy":
+		return EncodeNPY(w, i)
+	default:
+		return png.Encode(w, i)
+	}
 }
 
-func ImageI420(x, y int, points []byte) image.Image {
-	g := image.NewYCbCr(image.Rect(0, 0, x, y), image.YCbCrSubsampleRatio420)
+func checkSize(x, y, size int, points []byte) error {
+	if x <= 0 || y <= 0 {
+		return fmt.Errorf("invalid dimension %dx%d", x, y)
+	}
+	if len(points) < size {
+		return fmt.Errorf("%dx%d: want %d bytes, got %d", x, y, size, len(points))
+	}
+	return nil
+}
 
-	s := x * y
-	z := s / 4
-	copy(g.Y, points[:s])
+func ImageRGB(x, y int, points []byte) (image.Image, error) {
+	if err := checkSize(x, y, x*y*3, points); err != nil {
+		return nil, err
+	}
+	g := image.NewRGBA(image.Rect(0, 0, x, y))
+	for i, j := 0, 0; j < len(g.Pix); i, j = i+3, j+4 {
+		copy(g.Pix[j:j+3], points[i:i+3])
+		g.Pix[j+3] = 0xFF
+	}
+	return g, nil
+}
 
-	copy(g.Cb, points[s:s+z])
-	copy(g.Cr, points[len(points)-z:])
+// ImageYUYV decodes 4:2:2 frames whose bytes are ordered as Y0 Cb Y1 Cr.
+func ImageYUYV(x, y int, points []byte) (image.Image, error) {
+	return image422(x, y, points, 0, 1, 2, 3)
+}
 
-	return g
+// ImageUYVY decodes 4:2:2 frames whose bytes are ordered as Cb Y0 Cr Y1.
+func ImageUYVY(x, y int, points []byte) (image.Image, error) {
+	return image422(x, y, points, 1, 0, 3, 2)
 }
 
-func ImageGray8(x, y int, points []byte) image.Image {
-	g := image.NewGray(image.Rect(0, 0, x, y))
-	buf := bytes.NewBuffer(points)
-	for i := 0; i < y; i++ {
-		for j, c := range buf.Next(x) {
-			g.Set(j, i, color.Gray{Y: uint8(c)})
+func image422(x, y int, points []byte, y0, cb, y1, cr int) (image.Image, error) {
+	if x%2 != 0 {
+		return nil, fmt.Errorf("%dx%d: width should be even", x, y)
+	}
+	if err := checkSize(x, y, x*y*2, points); err != nil {
+		return nil, err
+	}
+	g := image.NewYCbCr(image.Rect(0, 0, x, y), image.YCbCrSubsampleRatio422)
+	for r := 0; r < y; r++ {
+		var (
+			ys = g.Y[r*g.YStride:]
+			bs = g.Cb[r*g.CStride:]
+			rs = g.Cr[r*g.CStride:]
+			ps = points[r*x*2:]
+		)
+		for k := 0; k < x/2; k++ {
+			o := k * 4
+			ys[2*k] = ps[o+y0]
+			ys[2*k+1] = ps[o+y1]
+			bs[k] = ps[o+cb]
+			rs[k] = ps[o+cr]
 		}
 	}
-	return g
+	return g, nil
 }
 
-func ImageGray16(x, y int, points []byte, order binary.ByteOrder) image.Image {
+func ImageI420(x, y int, points []byte) (image.Image, error) {
+	cx, cy := (x+1)/2, (y+1)/2
+	if err := checkSize(x, y, x*y+2*cx*cy, points); err != nil {
+		return nil, err
+	}
+	g := image.NewYCbCr(image.Rect(0, 0, x, y), image.YCbCrSubsampleRatio420)
+	for r := 0; r < y; r++ {
+		copy(g.Y[r*g.YStride:r*g.YStride+x], points[r*x:])
+	}
+	bs := points[x*y:]
+	rs := bs[cx*cy:]
+	for r := 0; r < cy; r++ {
+		copy(g.Cb[r*g.CStride:r*g.CStride+cx], bs[r*cx:])
+		copy(g.Cr[r*g.CStride:r*g.CStride+cx], rs[r*cx:])
+	}
+	return g, nil
+}
+
+func ImageGray8(x, y int, points []byte) (image.Image, error) {
+	if err := checkSize(x, y, x*y, points); err != nil {
+		return nil, err
+	}
+	g := image.NewGray(image.Rect(0, 0, x, y))
+	copy(g.Pix, points)
+	return g, nil
+}
+
+// ImageGray16 decodes frames of 16 bits pixels stored in the given byte order.
+func ImageGray16(x, y int, points []byte, order binary.ByteOrder) (image.Image, error) {
+	if err := checkSize(x, y, x*y*2, points); err != nil {
+		return nil, err
+	}
 	g := image.NewGray16(image.Rect(0, 0, x, y))
-	buf := bytes.NewBuffer(points)
-	for i := 0; i < y; i++ {
-		for j := 0; j < x; j++ {
-			var c uint16
-			binary.Read(buf, order, &c)
-			g.Set(j, i, color.Gray16{Y: c})
-		}
+	if order == binary.BigEndian {
+		copy(g.Pix, points)
+		return g, nil
+	}
+	for i := 0; i < len(g.Pix); i += 2 {
+		g.Pix[i], g.Pix[i+1] = points[i+1], points[i]
 	}
-	return g
+	return g, nil
 }
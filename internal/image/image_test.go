@@ -0,0 +1,127 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/busoc/panda"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images of testdata")
+
+type sample struct {
+	Name string
+	FCC  []byte
+	X, Y int
+	With Demosaic
+}
+
+var samples = []sample{
+	{Name: "y800", FCC: panda.Y800, X: 8, Y: 6},
+	{Name: "y16b", FCC: panda.Y16B, X: 8, Y: 6},
+	{Name: "y16l", FCC: panda.Y16L, X: 8, Y: 6},
+	{Name: "yuy2", FCC: panda.YUY2, X: 8, Y: 6},
+	{Name: "yuyv", FCC: YUYV, X: 8, Y: 6},
+	{Name: "uyvy", FCC: UYVY, X: 8, Y: 6},
+	{Name: "i420", FCC: panda.I420, X: 8, Y: 6},
+	{Name: "i420-odd", FCC: panda.I420, X: 7, Y: 5},
+	{Name: "rgb", FCC: panda.RGB, X: 8, Y: 6},
+	{Name: "rggb", FCC: RGGB, X: 8, Y: 6},
+	{Name: "bggr", FCC: BGGR, X: 8, Y: 6},
+	{Name: "grbg", FCC: GRBG, X: 8, Y: 6},
+	{Name: "gbrg", FCC: GBRG, X: 8, Y: 6},
+	{Name: "rggb-nearest", FCC: RGGB, X: 8, Y: 6, With: Nearest},
+	{Name: "y10p", FCC: Y10P, X: 8, Y: 6},
+	{Name: "y12p", FCC: Y12P, X: 8, Y: 6},
+}
+
+func TestDecodeGolden(t *testing.T) {
+	for _, f := range samples {
+		n, ok := FrameSize(f.FCC, f.X, f.Y)
+		if !ok {
+			t.Errorf("%s: no frame size", f.Name)
+			continue
+		}
+		i, err := DecodeWith(binary.BigEndian.Uint32(f.FCC), f.X, f.Y, pattern(n), f.With)
+		if err != nil {
+			t.Errorf("%s: decoding failed: %s", f.Name, err)
+			continue
+		}
+		if s := i.Bounds().Size(); s.X != f.X || s.Y != f.Y {
+			t.Errorf("%s: want %dx%d, got %dx%d", f.Name, f.X, f.Y, s.X, s.Y)
+			continue
+		}
+		file := filepath.Join("testdata", f.Name+".png")
+		if *update {
+			var w bytes.Buffer
+			if err := png.Encode(&w, i); err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+			if err := ioutil.WriteFile(file, w.Bytes(), 0644); err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+			continue
+		}
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("%s: %s", f.Name, err)
+			continue
+		}
+		want, err := png.Decode(bytes.NewReader(bs))
+		if err != nil {
+			t.Errorf("%s: %s", f.Name, err)
+			continue
+		}
+		if err := samePixels(want, i); err != nil {
+			t.Errorf("%s: %s", f.Name, err)
+		}
+	}
+}
+
+func TestDecodeShortFrame(t *testing.T) {
+	for _, f := range samples {
+		n, _ := FrameSize(f.FCC, f.X, f.Y)
+		_, err := DecodeWith(binary.BigEndian.Uint32(f.FCC), f.X, f.Y, pattern(n-1), f.With)
+		if err == nil {
+			t.Errorf("%s: short frame decoded", f.Name)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	const x, y = 1024, 768
+	for _, f := range samples {
+		n, _ := FrameSize(f.FCC, x, y)
+		var (
+			fcc = binary.BigEndian.Uint32(f.FCC)
+			bs  = pattern(n)
+		)
+		b.Run(f.Name, func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodeWith(fcc, x, y, bs, f.With); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestImageY10P(t *testing.T) {
+	i, err := ImageY10P(4, 1, []byte{0x80, 0x00, 0xFF, 0x40, 0xE4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := i.(*image.Gray16)
+	for x, want := range []uint16{0x8020, 0x0040, 0xFFBF, 0x40D0} {
+		if got := g.Gray16At(x, 0).Y; got != want {
+			t.Errorf("pixel %d: want %04x, got %04x", x, want, got)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// FourCC of the Bayer mosaics (8 bits per sample) and of the gray frames
+// packed on 10 and 12 bits as defined by MIPI CSI-2.
+var (
+	RGGB = []byte("RGGB")
+	BGGR = []byte("BGGR")
+	GRBG = []byte("GRBG")
+	GBRG = []byte("GBRG")
+	Y10P = []byte("Y10P")
+	Y12P = []byte("Y12P")
+)
+
+// Demosaic is the method used to rebuild the colour image of a Bayer mosaic.
+type Demosaic int
+
+const (
+	// Bilinear interpolates the missing colours of a pixel from its
+	// neighbours.
+	Bilinear Demosaic = iota
+	// Nearest gives the same colour to the four pixels of a cell of the
+	// mosaic. It is faster but halves the resolution.
+	Nearest
+)
+
+func (d Demosaic) String() string {
+	switch d {
+	case Nearest:
+		return "nearest"
+	default:
+		return "bilinear"
+	}
+}
+
+func ParseDemosaic(v string) (Demosaic, error) {
+	switch strings.ToLower(v) {
+	case "", "bilinear":
+		return Bilinear, nil
+	case "nearest":
+		return Nearest, nil
+	default:
+		return Bilinear, fmt.Errorf("unknown demosaic %s", v)
+	}
+}
+
+// ImageBayer rebuilds the colours of a mosaic whose first cell is given by
+// pattern (eg: RGGB).
+func ImageBayer(x, y int, points []byte, pattern string, d Demosaic) (image.Image, error) {
+	if len(pattern) != 4 || strings.Trim(strings.ToUpper(pattern), "RGB") != "" {
+		return nil, fmt.Errorf("invalid pattern %s", pattern)
+	}
+	if x%2 != 0 || y%2 != 0 {
+		return nil, fmt.Errorf("%dx%d: dimension should be even", x, y)
+	}
+	if err := checkSize(x, y, x*y, points); err != nil {
+		return nil, err
+	}
+	var cs [4]int
+	for i, c := range strings.ToUpper(pattern) {
+		cs[i] = strings.IndexRune("RGB", c)
+	}
+	g := image.NewRGBA(image.Rect(0, 0, x, y))
+	if d == Nearest {
+		nearestBayer(g, x, y, points, cs)
+	} else {
+		bilinearBayer(g, x, y, points, cs)
+	}
+	return g, nil
+}
+
+func nearestBayer(g *image.RGBA, x, y int, points []byte, cs [4]int) {
+	for r := 0; r < y; r += 2 {
+		for c := 0; c < x; c += 2 {
+			var (
+				rgb [3]int
+				n   [3]int
+			)
+			for i, o := range []int{r*x + c, r*x + c + 1, (r+1)*x + c, (r+1)*x + c + 1} {
+				rgb[cs[i]] += int(points[o])
+				n[cs[i]]++
+			}
+			for i := range rgb {
+				if n[i] > 0 {
+					rgb[i] /= n[i]
+				}
+			}
+			for _, o := range []int{r*g.Stride + c*4, r*g.Stride + c*4 + 4, (r+1)*g.Stride + c*4, (r+1)*g.Stride + c*4 + 4} {
+				g.Pix[o], g.Pix[o+1], g.Pix[o+2], g.Pix[o+3] = uint8(rgb[0]), uint8(rgb[1]), uint8(rgb[2]), 0xFF
+			}
+		}
+	}
+}
+
+// bilinearBayer gives to each pixel the average of the samples of each colour
+// found in its 3x3 neighbourhood, the sample of the pixel itself being kept
+// for its own colour.
+func bilinearBayer(g *image.RGBA, x, y int, points []byte, cs [4]int) {
+	for r := 0; r < y; r++ {
+		for c := 0; c < x; c++ {
+			var (
+				rgb [3]int
+				n   [3]int
+				own = cs[(r&1)*2+c&1]
+			)
+			for j := r - 1; j <= r+1; j++ {
+				if j < 0 || j >= y {
+					continue
+				}
+				for i := c - 1; i <= c+1; i++ {
+					if i < 0 || i >= x {
+						continue
+					}
+					if k := cs[(j&1)*2+i&1]; k != own {
+						rgb[k] += int(points[j*x+i])
+						n[k]++
+					}
+				}
+			}
+			rgb[own], n[own] = int(points[r*x+c]), 1
+			o := r*g.Stride + c*4
+			for i := range rgb {
+				if n[i] > 0 {
+					g.Pix[o+i] = uint8(rgb[i] / n[i])
+				}
+			}
+			g.Pix[o+3] = 0xFF
+		}
+	}
+}
+
+// ImageY10P decodes gray frames packed on 10 bits: each group of 5 bytes
+// holds the 8 high bits of 4 pixels followed by their 2 low bits. Samples are
+// scaled to 16 bits.
+func ImageY10P(x, y int, points []byte) (image.Image, error) {
+	return imagePacked(x, y, points, 10)
+}
+
+// ImageY12P decodes gray frames packed on 12 bits: each group of 3 bytes
+// holds the 8 high bits of 2 pixels followed by their 4 low bits. Samples are
+// scaled to 16 bits.
+func ImageY12P(x, y int, points []byte) (image.Image, error) {
+	return imagePacked(x, y, points, 12)
+}
+
+func imagePacked(x, y int, points []byte, bits int) (image.Image, error) {
+	var (
+		n    = 8 / (bits - 8) // pixels by group
+		size = n + 1          // bytes by group
+		low  = uint(bits - 8)
+		mask = uint16(1<<low - 1)
+	)
+	if err := checkSize(x, y, (x*y+n-1)/n*size, points); err != nil {
+		return nil, err
+	}
+	g := image.NewGray16(image.Rect(0, 0, x, y))
+	for i := 0; i < x*y; i++ {
+		var (
+			k = i / n * size
+			j = uint(i % n)
+			v = uint16(points[k+int(j)])<<low | uint16(points[k+n])>>(j*low)&mask
+		)
+		// replicate the high bits in the low ones to use the full range
+		v = v<<(16-uint(bits)) | v>>(2*uint(bits)-16)
+		g.Pix[2*i], g.Pix[2*i+1] = uint8(v>>8), uint8(v)
+	}
+	return g, nil
+}
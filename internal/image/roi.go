@@ -0,0 +1,139 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Geometry tells where a frame was taken on the sensor of a camera: the size
+// of the sensor and the region of interest transmitted, both in pixels of the
+// sensor.
+type Geometry struct {
+	Sensor image.Point
+	Region image.Rectangle
+}
+
+// Valid tells if the region is inside the sensor. Both are given by the
+// headers of the products and can not be trusted.
+func (g Geometry) Valid() bool {
+	if g.Sensor.X < 0 || g.Sensor.Y < 0 {
+		return false
+	}
+	if g.Region.Empty() {
+		return true
+	}
+	if g.Region.Min.X < 0 || g.Region.Min.Y < 0 {
+		return false
+	}
+	return g.Sensor == image.Point{} || g.Region.In(image.Rectangle{Max: g.Sensor})
+}
+
+// ROI rebuilds a frame according to its geometry. Canvas places the frame on
+// an image the size of the sensor, Unscale resizes the frame to the size of
+// its region and Overlay draws the outline of the region.
+type ROI struct {
+	Geometry
+
+	Canvas  bool
+	Unscale bool
+	Overlay bool
+}
+
+// ParseROI gives the options of a ROI from a comma separated list of
+// canvas, unscale and overlay. An empty list means canvas and unscale.
+func ParseROI(v string) (ROI, error) {
+	var r ROI
+	if v == "" {
+		r.Canvas, r.Unscale = true, true
+		return r, nil
+	}
+	for _, o := range strings.Split(v, ",") {
+		switch strings.ToLower(strings.TrimSpace(o)) {
+		case "canvas":
+			r.Canvas = true
+		case "unscale":
+			r.Unscale = true
+		case "overlay":
+			r.Overlay = true
+		default:
+			return r, fmt.Errorf("unknown roi option %s", o)
+		}
+	}
+	return r, nil
+}
+
+// Transform rebuilds i according to the geometry of r. Frames with an invalid
+// geometry are given as is and the canvas is reduced, with the frame, to fit
+// in MaxDimension.
+func (r ROI) Transform(i image.Image) image.Image {
+	if !r.Valid() {
+		return i
+	}
+	region := r.Region
+	if region.Empty() {
+		region = image.Rectangle{Max: r.Sensor}
+	}
+	b := i.Bounds()
+	if region.Empty() || b.Empty() {
+		return i
+	}
+	if r.Unscale && b.Size() != region.Size() {
+		i = Resize(region.Dx(), region.Dy()).Transform(i)
+		b = i.Bounds()
+	}
+	roi := b
+	if r.Canvas && r.Sensor.X > 0 && r.Sensor.Y > 0 {
+		// the canvas keeps the scale of the frame when it is not unscaled
+		var (
+			fx = float64(b.Dx()) / float64(region.Dx())
+			fy = float64(b.Dy()) / float64(region.Dy())
+			w  = float64(r.Sensor.X) * fx
+			h  = float64(r.Sensor.Y) * fy
+		)
+		if s := math.Min(MaxDimension/w, MaxDimension/h); s < 1 {
+			dx := int(math.Max(1, math.Floor(float64(b.Dx())*s)))
+			dy := int(math.Max(1, math.Floor(float64(b.Dy())*s)))
+			i = Resize(dx, dy).Transform(i)
+			b = i.Bounds()
+			fx, fy = fx*s, fy*s
+			w, h = math.Min(w*s, MaxDimension), math.Min(h*s, MaxDimension)
+		}
+		var (
+			x = int(math.Round(float64(region.Min.X) * fx))
+			y = int(math.Round(float64(region.Min.Y) * fy))
+		)
+		c := newLike(i, image.Rect(0, 0, int(math.Round(w)), int(math.Round(h))))
+		draw.Draw(c, c.Bounds(), image.Black, image.Point{}, draw.Src)
+		roi = image.Rect(x, y, x+b.Dx(), y+b.Dy())
+		draw.Draw(c, roi, i, b.Min, draw.Src)
+		i = c
+	}
+	if r.Overlay {
+		i = outline(i, roi)
+	}
+	return i
+}
+
+// outline draws the border of r on a copy of i.
+func outline(i image.Image, r image.Rectangle) image.Image {
+	g := image.NewRGBA(i.Bounds())
+	draw.Draw(g, g.Bounds(), i, i.Bounds().Min, draw.Src)
+	if r = r.Intersect(g.Bounds()); r.Empty() {
+		return g
+	}
+	c := color.RGBA{R: 0xFF, A: 0xFF}
+	for x := r.Min.X; x < r.Max.X; x++ {
+		g.SetRGBA(x, r.Min.Y, c)
+		g.SetRGBA(x, r.Max.Y-1, c)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		g.SetRGBA(r.Min.X, y, c)
+		g.SetRGBA(r.Max.X-1, y, c)
+	}
+	return g
+}
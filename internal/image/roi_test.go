@@ -0,0 +1,78 @@
+package image
+
+import (
+	"image"
+	"testing"
+)
+
+func TestROITransform(t *testing.T) {
+	frame := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range frame.Pix {
+		frame.Pix[i] = 0xFF
+	}
+	data := []struct {
+		Name   string
+		ROI    ROI
+		Canvas image.Point
+	}{
+		{
+			Name:   "canvas",
+			ROI:    ROI{Geometry: Geometry{Sensor: image.Pt(100, 80), Region: image.Rect(10, 20, 50, 50)}, Canvas: true},
+			Canvas: image.Pt(100, 80),
+		},
+		{
+			Name:   "scaled",
+			ROI:    ROI{Geometry: Geometry{Sensor: image.Pt(400, 300), Region: image.Rect(0, 0, 80, 60)}, Canvas: true},
+			Canvas: image.Pt(200, 150),
+		},
+		{
+			Name:   "outside",
+			ROI:    ROI{Geometry: Geometry{Sensor: image.Pt(100, 80), Region: image.Rect(90, 70, 130, 100)}, Canvas: true},
+			Canvas: image.Pt(40, 30),
+		},
+		{
+			Name:   "negative",
+			ROI:    ROI{Geometry: Geometry{Sensor: image.Pt(100, 80), Region: image.Rect(-10, 0, 30, 30)}, Canvas: true},
+			Canvas: image.Pt(40, 30),
+		},
+		{
+			Name:   "tiny-region",
+			ROI:    ROI{Geometry: Geometry{Sensor: image.Pt(65535, 65535), Region: image.Rect(0, 0, 1, 1)}, Canvas: true},
+			Canvas: image.Pt(MaxDimension, 6144),
+		},
+		{
+			Name:   "unscale",
+			ROI:    ROI{Geometry: Geometry{Sensor: image.Pt(65535, 60000), Region: image.Rect(0, 0, 2, 2)}, Canvas: true, Unscale: true},
+			Canvas: image.Pt(MaxDimension, 7500),
+		},
+	}
+	for _, d := range data {
+		i := d.ROI.Transform(frame)
+		if s := i.Bounds().Size(); s != d.Canvas {
+			t.Errorf("%s: want %s, got %s", d.Name, d.Canvas, s)
+		}
+	}
+}
+
+func TestROIPlacement(t *testing.T) {
+	frame := image.NewGray(image.Rect(0, 0, 4, 2))
+	for i := range frame.Pix {
+		frame.Pix[i] = 0xFF
+	}
+	r := ROI{Geometry: Geometry{Sensor: image.Pt(10, 6), Region: image.Rect(3, 2, 7, 4)}, Canvas: true}
+	g, ok := r.Transform(frame).(*image.Gray)
+	if !ok {
+		t.Fatalf("unexpected image type %T", r.Transform(frame))
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 10; x++ {
+			want := uint8(0)
+			if image.Pt(x, y).In(r.Region) {
+				want = 0xFF
+			}
+			if got := g.GrayAt(x, y).Y; got != want {
+				t.Errorf("pixel (%d,%d): want %02x, got %02x", x, y, want, got)
+			}
+		}
+	}
+}
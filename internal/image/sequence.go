@@ -0,0 +1,356 @@
+package image
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Label writes s in white over a black box in the top left corner of an
+// image.
+func Label(s string) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		b := i.Bounds()
+		g := newLike(i, b)
+		draw.Draw(g, b, i, b.Min, draw.Src)
+
+		f := basicfont.Face7x13
+		d := font.Drawer{Dst: g, Src: image.White, Face: f}
+		box := image.Rect(0, 0, d.MeasureString(s).Ceil()+4, f.Height+4).Add(b.Min)
+		draw.Draw(g, box.Intersect(b), image.Black, image.Point{}, draw.Src)
+		d.Dot = fixed.P(b.Min.X+2, b.Min.Y+2+f.Ascent)
+		d.DrawString(s)
+		return g
+	})
+}
+
+// Sequence encodes frames as an animated GIF (gif), a MJPEG video in an AVI
+// container (avi) or a zip archive of numbered PNG files (zip). The size of
+// the sequence is the size of its first frame; other frames are scaled to
+// it.
+type Sequence interface {
+	Add(image.Image) error
+	Close() error
+}
+
+func NewSequence(w io.Writer, format string, fps int) (Sequence, error) {
+	if fps <= 0 {
+		return nil, fmt.Errorf("invalid frame rate %d", fps)
+	}
+	switch format {
+	case "gif":
+		return &gifSequence{writer: w, delay: (100 + fps/2) / fps}, nil
+	case "avi", "x-msvideo":
+		return &aviSequence{writer: w, fps: fps}, nil
+	case "zip":
+		return &zipSequence{writer: zip.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported sequence format %s", format)
+	}
+}
+
+type frames struct {
+	size image.Rectangle
+}
+
+// fit scales i to the size of the first frame.
+func (f *frames) fit(i image.Image) image.Image {
+	b := i.Bounds()
+	if f.size.Empty() {
+		f.size = image.Rect(0, 0, b.Dx(), b.Dy())
+	}
+	if b.Size() == f.size.Size() {
+		return i
+	}
+	g := newLike(i, f.size)
+	draw.BiLinear.Scale(g, f.size, i, b, draw.Src, nil)
+	return g
+}
+
+// gifSequence writes each frame once it is added: frames are encoded as
+// single GIF images whose palette becomes the local colour table of the frame
+// in the sequence.
+type gifSequence struct {
+	frames
+	writer io.Writer
+	delay  int
+	count  int
+}
+
+func (s *gifSequence) Add(i image.Image) error {
+	i = s.fit(i)
+	ps := color.Palette(palette.Plan9)
+	if isGray(i) {
+		ps = make(color.Palette, 256)
+		for j := range ps {
+			ps[j] = color.Gray{Y: uint8(j)}
+		}
+	}
+	p := image.NewPaletted(s.size, ps)
+	draw.FloydSteinberg.Draw(p, s.size, i, i.Bounds().Min)
+
+	var f bytes.Buffer
+	if err := gif.Encode(&f, p, &gif.Options{NumColors: len(ps)}); err != nil {
+		return err
+	}
+	table, data, err := splitGIF(f.Bytes())
+	if err != nil {
+		return err
+	}
+	x, y := uint16(s.size.Dx()), uint16(s.size.Dy())
+
+	var w bytes.Buffer
+	if s.count == 0 {
+		// header, screen without global colour table and infinite loop
+		w.WriteString("GIF89a")
+		binary.Write(&w, binary.LittleEndian, []uint16{x, y})
+		w.Write([]byte{0, 0, 0})
+		w.Write([]byte{0x21, 0xFF, 0x0B})
+		w.WriteString("NETSCAPE2.0")
+		w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+	}
+	w.Write([]byte{0x21, 0xF9, 0x04, 0x00})
+	binary.Write(&w, binary.LittleEndian, uint16(s.delay))
+	w.Write([]byte{0x00, 0x00})
+
+	w.WriteByte(0x2C)
+	binary.Write(&w, binary.LittleEndian, []uint16{0, 0, x, y})
+	w.WriteByte(0x80 | gifTableSize(len(table)))
+	w.Write(table)
+	w.Write(data)
+	if _, err := w.WriteTo(s.writer); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+func (s *gifSequence) Close() error {
+	if s.count == 0 {
+		return fmt.Errorf("empty sequence")
+	}
+	_, err := s.writer.Write([]byte{0x3B})
+	return err
+}
+
+// splitGIF gives the colour table and the data (LZW code size and blocks) of
+// the first image of the GIF file bs.
+func splitGIF(bs []byte) ([]byte, []byte, error) {
+	short := fmt.Errorf("gif: short image")
+	if len(bs) < 13 {
+		return nil, nil, short
+	}
+	var (
+		table  []byte
+		offset = 13
+	)
+	if f := bs[10]; f&0x80 != 0 {
+		n := 3 << (f&7 + 1)
+		if offset+n > len(bs) {
+			return nil, nil, short
+		}
+		table, offset = bs[offset:offset+n], offset+n
+	}
+	for offset < len(bs) {
+		switch bs[offset] {
+		case 0x21:
+			// extension: label and data sub-blocks
+			offset += 2
+			for offset < len(bs) && bs[offset] != 0 {
+				offset += int(bs[offset]) + 1
+			}
+			offset++
+		case 0x2C:
+			if offset+10 > len(bs) {
+				return nil, nil, short
+			}
+			if f := bs[offset+9]; f&0x80 != 0 {
+				n := 3 << (f&7 + 1)
+				if offset+10+n > len(bs) {
+					return nil, nil, short
+				}
+				table = bs[offset+10 : offset+10+n]
+				offset += n
+			}
+			offset += 10
+			end := len(bs)
+			if bs[end-1] == 0x3B {
+				end--
+			}
+			if table == nil || offset >= end {
+				return nil, nil, fmt.Errorf("gif: no colour table or data")
+			}
+			return table, bs[offset:end], nil
+		default:
+			return nil, nil, fmt.Errorf("gif: unexpected block %02x", bs[offset])
+		}
+	}
+	return nil, nil, short
+}
+
+// gifTableSize gives the size field of a colour table of n bytes.
+func gifTableSize(n int) byte {
+	var z byte
+	for 3<<(z+1) < n {
+		z++
+	}
+	return z
+}
+
+type zipSequence struct {
+	frames
+	writer *zip.Writer
+	count  int
+}
+
+func (s *zipSequence) Add(i image.Image) error {
+	s.count++
+	h := zip.FileHeader{
+		Name:     fmt.Sprintf("frame-%05d.png", s.count),
+		Method:   zip.Store,
+		Modified: time.Now(),
+	}
+	w, err := s.writer.CreateHeader(&h)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, s.fit(i))
+}
+
+func (s *zipSequence) Close() error {
+	return s.writer.Close()
+}
+
+// aviSequence keeps the frames encoded as JPEG until the sequence is closed
+// since the headers of an AVI file give the number and the size of its
+// frames.
+type aviSequence struct {
+	frames
+	writer io.Writer
+	fps    int
+	jpegs  [][]byte
+}
+
+func (s *aviSequence) Add(i image.Image) error {
+	var w bytes.Buffer
+	if err := jpeg.Encode(&w, s.fit(i), &jpeg.Options{Quality: 90}); err != nil {
+		return err
+	}
+	s.jpegs = append(s.jpegs, w.Bytes())
+	return nil
+}
+
+const (
+	aviHasIndex = 0x10
+	aviKeyFrame = 0x10
+)
+
+// Close writes the headers with the sizes computed from the frames followed
+// by the frames and their index.
+func (s *aviSequence) Close() error {
+	if len(s.jpegs) == 0 {
+		return fmt.Errorf("empty sequence")
+	}
+	var (
+		movi   = 4
+		buffer int
+	)
+	for _, bs := range s.jpegs {
+		movi += 8 + len(bs) + len(bs)%2
+		if len(bs) > buffer {
+			buffer = len(bs)
+		}
+	}
+	x, y := uint32(s.size.Dx()), uint32(s.size.Dy())
+	n := uint32(len(s.jpegs))
+
+	var avih bytes.Buffer
+	binary.Write(&avih, binary.LittleEndian, []uint32{
+		uint32(time.Second/time.Microsecond) / uint32(s.fps),
+		uint32(buffer * s.fps),
+		0,
+		aviHasIndex,
+		n,
+		0,
+		1,
+		uint32(buffer),
+		x,
+		y,
+		0, 0, 0, 0,
+	})
+	var strh bytes.Buffer
+	strh.WriteString("vidsMJPG")
+	binary.Write(&strh, binary.LittleEndian, []uint32{0, 0, 0, 1, uint32(s.fps), 0, n, uint32(buffer), 0xFFFFFFFF, 0})
+	binary.Write(&strh, binary.LittleEndian, []uint16{0, 0, uint16(x), uint16(y)})
+
+	var strf bytes.Buffer
+	binary.Write(&strf, binary.LittleEndian, []uint32{40, x, y})
+	binary.Write(&strf, binary.LittleEndian, []uint16{1, 24})
+	strf.WriteString("MJPG")
+	binary.Write(&strf, binary.LittleEndian, []uint32{x * y * 3, 0, 0, 0, 0})
+
+	strl := riffList("strl", riffChunk("strh", strh.Bytes()), riffChunk("strf", strf.Bytes()))
+	hdrl := riffList("hdrl", riffChunk("avih", avih.Bytes()), strl)
+
+	index := 16 * len(s.jpegs)
+	w := bufio.NewWriter(s.writer)
+	w.WriteString("RIFF")
+	binary.Write(w, binary.LittleEndian, uint32(4+len(hdrl)+8+movi+8+index))
+	w.WriteString("AVI ")
+	w.Write(hdrl)
+	w.WriteString("LIST")
+	binary.Write(w, binary.LittleEndian, uint32(movi))
+	w.WriteString("movi")
+	for _, bs := range s.jpegs {
+		w.WriteString("00dc")
+		binary.Write(w, binary.LittleEndian, uint32(len(bs)))
+		w.Write(bs)
+		if len(bs)%2 == 1 {
+			w.WriteByte(0)
+		}
+	}
+	// offsets of the frames are given from the start of the movi list
+	w.WriteString("idx1")
+	binary.Write(w, binary.LittleEndian, uint32(index))
+	offset := 4
+	for _, bs := range s.jpegs {
+		w.WriteString("00dc")
+		binary.Write(w, binary.LittleEndian, []uint32{aviKeyFrame, uint32(offset), uint32(len(bs))})
+		offset += 8 + len(bs) + len(bs)%2
+	}
+	return w.Flush()
+}
+
+func riffChunk(id string, bs []byte) []byte {
+	var w bytes.Buffer
+	w.WriteString(id)
+	binary.Write(&w, binary.LittleEndian, uint32(len(bs)))
+	w.Write(bs)
+	if len(bs)%2 == 1 {
+		w.WriteByte(0)
+	}
+	return w.Bytes()
+}
+
+func riffList(kind string, cs ...[]byte) []byte {
+	bs := []byte(kind)
+	for _, c := range cs {
+		bs = append(bs, c...)
+	}
+	return riffChunk("LIST", bs)
+}
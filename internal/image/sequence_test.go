@@ -0,0 +1,95 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"testing"
+)
+
+func TestSequenceGIF(t *testing.T) {
+	var w bytes.Buffer
+	s, err := NewSequence(&w, "gif", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, _ := ImageGray8(8, 6, pattern(48))
+	rgb, _ := ImageRGB(16, 12, pattern(16*12*3))
+	for _, i := range []image.Image{gray, rgb, gray} {
+		if err := s.Add(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&w)
+	if err != nil {
+		t.Fatalf("decoding failed: %s", err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("want 3 frames, got %d", len(g.Image))
+	}
+	for j, i := range g.Image {
+		if s := i.Bounds().Size(); s.X != 8 || s.Y != 6 {
+			t.Errorf("frame %d: want 8x6, got %dx%d", j, s.X, s.Y)
+		}
+		if g.Delay[j] != 25 {
+			t.Errorf("frame %d: want delay 25, got %d", j, g.Delay[j])
+		}
+	}
+	if err := samePixels(gray, g.Image[0]); err != nil {
+		t.Errorf("frame 0: %s", err)
+	}
+}
+
+func TestSequenceAVI(t *testing.T) {
+	var w bytes.Buffer
+	s, err := NewSequence(&w, "avi", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgb, _ := ImageRGB(16, 12, pattern(16*12*3))
+	for j := 0; j < 3; j++ {
+		if err := s.Add(rgb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bs := w.Bytes()
+	if string(bs[:4]) != "RIFF" || string(bs[8:12]) != "AVI " {
+		t.Fatalf("not an AVI file")
+	}
+	if n := binary.LittleEndian.Uint32(bs[4:]); int(n) != len(bs)-8 {
+		t.Fatalf("RIFF size: want %d, got %d", len(bs)-8, n)
+	}
+	movi := bytes.Index(bs, []byte("movi"))
+	idx := bytes.Index(bs, []byte("idx1"))
+	if movi < 0 || idx < 0 {
+		t.Fatalf("movi or idx1 not found")
+	}
+	if n := binary.LittleEndian.Uint32(bs[movi-4:]); int(n) != idx-movi {
+		t.Errorf("movi size: want %d, got %d", idx-movi, n)
+	}
+	index := bs[idx+8:]
+	if len(index) != 3*16 {
+		t.Fatalf("index: want %d bytes, got %d", 3*16, len(index))
+	}
+	for j := 0; j < 3; j++ {
+		var (
+			e      = index[j*16:]
+			offset = int(binary.LittleEndian.Uint32(e[8:]))
+			size   = binary.LittleEndian.Uint32(e[12:])
+			chunk  = bs[movi+offset:]
+		)
+		if string(chunk[:4]) != "00dc" || binary.LittleEndian.Uint32(chunk[4:]) != size {
+			t.Errorf("frame %d: index does not point to its chunk", j)
+		}
+		if !bytes.HasPrefix(chunk[8:], []byte{0xFF, 0xD8}) {
+			t.Errorf("frame %d: not a JPEG", j)
+		}
+	}
+}
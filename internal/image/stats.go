@@ -0,0 +1,86 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Bins is the number of bins of the histogram given by Statistics.
+const Bins = 16
+
+// Stats summarizes the luminance of the pixels of an image. Values are given
+// in the depth of the image (8 or 16 bits). Saturated and Zero are the share
+// (between 0 and 1) of pixels at the maximum value of the depth and at 0.
+type Stats struct {
+	Depth     int     `xml:"depth,attr" json:"depth"`
+	Min       int     `xml:"min" json:"min"`
+	Max       int     `xml:"max" json:"max"`
+	Mean      float64 `xml:"mean" json:"mean"`
+	Stddev    float64 `xml:"stddev" json:"stddev"`
+	Median    int     `xml:"median" json:"median"`
+	Saturated float64 `xml:"saturated" json:"saturated"`
+	Zero      float64 `xml:"zero" json:"zero"`
+	Histogram []int   `xml:"histogram>bin" json:"histogram"`
+}
+
+// Statistics computes the Stats of i. The histogram splits the range of the
+// depth of the image in Bins bins of equal width.
+func Statistics(i image.Image) Stats {
+	var (
+		b     = i.Bounds()
+		s     = Stats{Depth: 8, Min: -1, Histogram: make([]int, Bins)}
+		top   = 0xFF
+		count = make([]int, 1<<16)
+		value func(x, y int) int
+	)
+	switch g := i.(type) {
+	case *image.Gray16:
+		s.Depth, top = 16, 0xFFFF
+		value = func(x, y int) int {
+			return int(g.Gray16At(x, y).Y)
+		}
+	case *image.Gray:
+		value = func(x, y int) int {
+			return int(g.GrayAt(x, y).Y)
+		}
+	default:
+		value = func(x, y int) int {
+			return int(color.GrayModel.Convert(i.At(x, y)).(color.Gray).Y)
+		}
+	}
+	n := b.Dx() * b.Dy()
+	if n <= 0 {
+		s.Min = 0
+		return s
+	}
+	var sum, square float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := value(x, y)
+			count[v]++
+			sum += float64(v)
+			square += float64(v) * float64(v)
+		}
+	}
+	var seen int
+	for v, c := range count[:top+1] {
+		if c == 0 {
+			continue
+		}
+		if s.Min < 0 {
+			s.Min = v
+		}
+		s.Max = v
+		if seen < (n+1)/2 && seen+c >= (n+1)/2 {
+			s.Median = v
+		}
+		seen += c
+		s.Histogram[v*Bins/(top+1)] += c
+	}
+	s.Mean = sum / float64(n)
+	s.Stddev = math.Sqrt(math.Max(square/float64(n)-s.Mean*s.Mean, 0))
+	s.Saturated = float64(count[top]) / float64(n)
+	s.Zero = float64(count[0]) / float64(n)
+	return s
+}
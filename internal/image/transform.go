@@ -0,0 +1,521 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+type Transform interface {
+	Transform(image.Image) image.Image
+}
+
+type TransformFunc func(image.Image) image.Image
+
+func (f TransformFunc) Transform(i image.Image) image.Image {
+	return f(i)
+}
+
+func Apply(i image.Image, ts ...Transform) image.Image {
+	for _, t := range ts {
+		i = t.Transform(i)
+	}
+	return i
+}
+
+// Parse gives the transforms found in a query string in the order they
+// appear. Parameters that are not transforms are ignored.
+//
+//	crop=x,y,width,height
+//	resize=WIDTHxHEIGHT (one side can be omitted to keep the ratio)
+//	thumbnail[=size]
+//	rotate=90|180|270
+//	flip=h|v
+//	stretch[=percent]
+//	equalize
+//	palette=gray|hot|jet|viridis
+//	gamma=value
+func Parse(query string) ([]Transform, error) {
+	var ts []Transform
+	for _, p := range strings.Split(query, "&") {
+		if p == "" {
+			continue
+		}
+		k, v := p, ""
+		if ix := strings.Index(p, "="); ix >= 0 {
+			k, v = p[:ix], p[ix+1:]
+		}
+		k, _ = url.QueryUnescape(k)
+		v, _ = url.QueryUnescape(v)
+
+		var (
+			t   Transform
+			err error
+		)
+		switch strings.ToLower(k) {
+		default:
+			continue
+		case "crop":
+			t, err = parseCrop(v)
+		case "resize":
+			t, err = parseResize(v)
+		case "thumbnail":
+			n := DefaultThumbnail
+			if v != "" {
+				if n, err = strconv.Atoi(v); err == nil && (n <= 0 || n > MaxDimension) {
+					err = fmt.Errorf("size should be between 1 and %d", MaxDimension)
+				}
+			}
+			t = Thumbnail(n)
+		case "rotate":
+			t, err = parseRotate(v)
+		case "flip":
+			t, err = parseFlip(v)
+		case "stretch":
+			p := 1.0
+			if v != "" {
+				if p, err = strconv.ParseFloat(v, 64); err == nil && (p < 0 || p >= 50) {
+					err = fmt.Errorf("percent out of range")
+				}
+			}
+			t = Stretch(p)
+		case "equalize", "equalise":
+			t = Equalize()
+		case "palette":
+			t, err = Palette(v)
+		case "gamma":
+			var g float64
+			if g, err = strconv.ParseFloat(v, 64); err == nil && g <= 0 {
+				err = fmt.Errorf("gamma should be positive")
+			}
+			t = Gamma(g)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid value %q (%s)", k, v, err)
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+func parseCrop(v string) (Transform, error) {
+	var ns []int
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("expected x,y,width,height")
+		}
+		ns = append(ns, n)
+	}
+	if len(ns) != 4 || ns[2] == 0 || ns[3] == 0 {
+		return nil, fmt.Errorf("expected x,y,width,height")
+	}
+	return Crop(image.Rect(ns[0], ns[1], ns[0]+ns[2], ns[1]+ns[3])), nil
+}
+
+func parseResize(v string) (Transform, error) {
+	ix := strings.Index(strings.ToLower(v), "x")
+	if ix < 0 {
+		return nil, fmt.Errorf("expected WIDTHxHEIGHT")
+	}
+	var (
+		x, y int
+		err  error
+	)
+	if s := v[:ix]; s != "" {
+		if x, err = strconv.Atoi(s); err != nil || x <= 0 || x > MaxDimension {
+			return nil, fmt.Errorf("width should be between 1 and %d", MaxDimension)
+		}
+	}
+	if s := v[ix+1:]; s != "" {
+		if y, err = strconv.Atoi(s); err != nil || y <= 0 || y > MaxDimension {
+			return nil, fmt.Errorf("height should be between 1 and %d", MaxDimension)
+		}
+	}
+	if x == 0 && y == 0 {
+		return nil, fmt.Errorf("expected WIDTHxHEIGHT")
+	}
+	return Resize(x, y), nil
+}
+
+func parseRotate(v string) (Transform, error) {
+	d, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, err
+	}
+	switch d = ((d % 360) + 360) % 360; d {
+	case 0, 90, 180, 270:
+		return Rotate(d), nil
+	default:
+		return nil, fmt.Errorf("only multiples of 90 are supported")
+	}
+}
+
+func parseFlip(v string) (Transform, error) {
+	switch strings.ToLower(v) {
+	case "h", "horizontal":
+		return Flip(true), nil
+	case "v", "vertical":
+		return Flip(false), nil
+	default:
+		return nil, fmt.Errorf("expected h or v")
+	}
+}
+
+// Crop keeps the part of an image inside r. r is relative to the top left
+// corner of the image.
+func Crop(r image.Rectangle) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		b := i.Bounds()
+		r := r.Add(b.Min).Intersect(b)
+		if s, ok := i.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok {
+			return s.SubImage(r)
+		}
+		g := newLike(i, image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(g, g.Bounds(), i, r.Min, draw.Src)
+		return g
+	})
+}
+
+// MaxDimension is the largest width or height of a resized image.
+const MaxDimension = 8192
+
+// Resize scales an image to x by y pixels with a bilinear interpolation. When
+// x or y is zero, it is computed to keep the ratio of the image and limited to
+// MaxDimension.
+func Resize(x, y int) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		b := i.Bounds()
+		if b.Empty() {
+			return i
+		}
+		w, h := x, y
+		if w == 0 {
+			w = int(math.Round(float64(b.Dx()*h) / float64(b.Dy())))
+		}
+		if h == 0 {
+			h = int(math.Round(float64(b.Dy()*w) / float64(b.Dx())))
+		}
+		if w > MaxDimension {
+			w = MaxDimension
+		}
+		if h > MaxDimension {
+			h = MaxDimension
+		}
+		if w == 0 || h == 0 {
+			return i
+		}
+		g := newLike(i, image.Rect(0, 0, w, h))
+		draw.BiLinear.Scale(g, g.Bounds(), i, b, draw.Src, nil)
+		return g
+	})
+}
+
+const DefaultThumbnail = 160
+
+// Thumbnail reduces an image to fit in a n by n square. Images smaller than
+// the square are left unchanged.
+func Thumbnail(n int) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		b := i.Bounds()
+		switch {
+		case b.Dx() <= n && b.Dy() <= n:
+			return i
+		case b.Dx() >= b.Dy():
+			return Resize(n, 0).Transform(i)
+		default:
+			return Resize(0, n).Transform(i)
+		}
+	})
+}
+
+// Rotate turns an image clockwise by d degrees. d should be a multiple of 90.
+func Rotate(d int) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		b := i.Bounds()
+		w, h := b.Dx(), b.Dy()
+
+		var (
+			g   draw.Image
+			pos func(x, y int) (int, int)
+		)
+		switch d {
+		case 90:
+			g = newLike(i, image.Rect(0, 0, h, w))
+			pos = func(x, y int) (int, int) { return h - 1 - y, x }
+		case 180:
+			g = newLike(i, image.Rect(0, 0, w, h))
+			pos = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+		case 270:
+			g = newLike(i, image.Rect(0, 0, h, w))
+			pos = func(x, y int) (int, int) { return y, w - 1 - x }
+		default:
+			return i
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				px, py := pos(x, y)
+				g.Set(px, py, i.At(b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return g
+	})
+}
+
+// Flip mirrors an image horizontally (left to right) or vertically.
+func Flip(horizontal bool) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		b := i.Bounds()
+		w, h := b.Dx(), b.Dy()
+		g := newLike(i, image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				px, py := x, h-1-y
+				if horizontal {
+					px, py = w-1-x, y
+				}
+				g.Set(px, py, i.At(b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return g
+	})
+}
+
+// Stretch maps linearly the levels of an image between the lower and upper
+// p percentiles of its histogram to the full range.
+func Stretch(p float64) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		hs, n := histogram(i)
+		if n == 0 {
+			return i
+		}
+		var (
+			lo, hi = -1, -1
+			sum    int
+			cut    = int(float64(n) * p / 100)
+		)
+		for v, c := range hs {
+			sum += c
+			if lo < 0 && sum > cut {
+				lo = v
+			}
+			if hi < 0 && sum >= n-cut {
+				hi = v
+			}
+		}
+		if hi <= lo {
+			return i
+		}
+		var lut [1 << 16]uint16
+		for v := range lut {
+			switch {
+			case v <= lo:
+				lut[v] = 0
+			case v >= hi:
+				lut[v] = math.MaxUint16
+			default:
+				lut[v] = uint16((v - lo) * math.MaxUint16 / (hi - lo))
+			}
+		}
+		return levels(i, &lut)
+	})
+}
+
+// Equalize spreads the levels of an image according to its cumulative
+// histogram.
+func Equalize() Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		hs, n := histogram(i)
+		if n == 0 {
+			return i
+		}
+		var (
+			lut [1 << 16]uint16
+			sum int
+		)
+		for v, c := range hs {
+			sum += c
+			lut[v] = uint16(uint64(sum) * math.MaxUint16 / uint64(n))
+		}
+		return levels(i, &lut)
+	})
+}
+
+func Gamma(g float64) Transform {
+	return TransformFunc(func(i image.Image) image.Image {
+		var lut [1 << 16]uint16
+		for v := range lut {
+			f := math.Pow(float64(v)/math.MaxUint16, 1/g)
+			lut[v] = uint16(math.Round(f * math.MaxUint16))
+		}
+		return levels(i, &lut)
+	})
+}
+
+var palettes = map[string][]color.RGBA{
+	"gray": {
+		{0, 0, 0, 255},
+		{255, 255, 255, 255},
+	},
+	"hot": {
+		{0, 0, 0, 255},
+		{230, 0, 0, 255},
+		{255, 210, 0, 255},
+		{255, 255, 255, 255},
+	},
+	"jet": {
+		{0, 0, 143, 255},
+		{0, 0, 255, 255},
+		{0, 255, 255, 255},
+		{255, 255, 0, 255},
+		{255, 0, 0, 255},
+		{128, 0, 0, 255},
+	},
+	"viridis": {
+		{68, 1, 84, 255},
+		{59, 82, 139, 255},
+		{33, 145, 140, 255},
+		{94, 201, 98, 255},
+		{253, 231, 37, 255},
+	},
+}
+
+// Palette gives false colours to an image according to the luminance of its
+// pixels.
+func Palette(n string) (Transform, error) {
+	ps, ok := palettes[strings.ToLower(n)]
+	if !ok {
+		return nil, fmt.Errorf("unknown palette %s", n)
+	}
+	var cs [256]color.RGBA
+	for i := range cs {
+		f := float64(i) / 255 * float64(len(ps)-1)
+		j := int(f)
+		if j >= len(ps)-1 {
+			cs[i] = ps[len(ps)-1]
+			continue
+		}
+		f -= float64(j)
+		a, b := ps[j], ps[j+1]
+		cs[i] = color.RGBA{
+			R: uint8(float64(a.R) + f*(float64(b.R)-float64(a.R))),
+			G: uint8(float64(a.G) + f*(float64(b.G)-float64(a.G))),
+			B: uint8(float64(a.B) + f*(float64(b.B)-float64(a.B))),
+			A: 255,
+		}
+	}
+	t := func(i image.Image) image.Image {
+		b := i.Bounds()
+		g := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := color.GrayModel.Convert(i.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+				g.SetRGBA(x, y, cs[c.Y])
+			}
+		}
+		return g
+	}
+	return TransformFunc(t), nil
+}
+
+func Palettes() []string {
+	ns := make([]string, 0, len(palettes))
+	for n := range palettes {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// histogram counts the 16 bits levels of all the channels of an image.
+func histogram(i image.Image) ([]int, int) {
+	var (
+		hs   = make([]int, 1<<16)
+		n    int
+		b    = i.Bounds()
+		gray = isGray(i)
+	)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if gray {
+				c := color.Gray16Model.Convert(i.At(x, y)).(color.Gray16)
+				hs[c.Y]++
+				n++
+				continue
+			}
+			r, g, b, _ := i.At(x, y).RGBA()
+			hs[r]++
+			hs[g]++
+			hs[b]++
+			n += 3
+		}
+	}
+	return hs, n
+}
+
+// levels applies lut to each channel of an image. The depth of gray images is
+// kept.
+func levels(i image.Image, lut *[1 << 16]uint16) image.Image {
+	b := i.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy())
+	switch i.(type) {
+	case *image.Gray:
+		g := image.NewGray(r)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := color.Gray16Model.Convert(i.At(b.Min.X+x, b.Min.Y+y)).(color.Gray16)
+				g.SetGray(x, y, color.Gray{Y: uint8(lut[c.Y] >> 8)})
+			}
+		}
+		return g
+	case *image.Gray16:
+		g := image.NewGray16(r)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := color.Gray16Model.Convert(i.At(b.Min.X+x, b.Min.Y+y)).(color.Gray16)
+				g.SetGray16(x, y, color.Gray16{Y: lut[c.Y]})
+			}
+		}
+		return g
+	default:
+		g := image.NewRGBA64(r)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				cr, cg, cb, ca := i.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				g.SetRGBA64(x, y, color.RGBA64{R: lut[cr], G: lut[cg], B: lut[cb], A: uint16(ca)})
+			}
+		}
+		return g
+	}
+}
+
+func isGray(i image.Image) bool {
+	switch i.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	default:
+		return false
+	}
+}
+
+func newLike(i image.Image, r image.Rectangle) draw.Image {
+	switch i.(type) {
+	case *image.Gray:
+		return image.NewGray(r)
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.RGBA64, *image.NRGBA64:
+		return image.NewRGBA64(r)
+	default:
+		return image.NewRGBA(r)
+	}
+}
@@ -0,0 +1,70 @@
+package science
+
+import (
+	"fmt"
+
+	"github.com/busoc/panda"
+)
+
+// Builtin gives the schemas of the science products known by hadock: SYNC
+// units, MMA and SVS data.
+func Builtin() Schemas {
+	s := make(Schemas)
+	for _, c := range []*Schema{syncUnit(), scienceData(), svsData()} {
+		s[c.Key()] = c
+	}
+	return s
+}
+
+func syncUnit() *Schema {
+	s := Schema{
+		FCC:    string(panda.SYNC),
+		Endian: "big",
+		Fields: []Field{
+			{Name: "time", Type: TypeTime},
+			{Name: "record", Type: TypeIndex, Offset: 1},
+			{Name: "records", Type: TypeCount},
+		},
+	}
+	for i := 1; i <= 2; i++ {
+		s.Fields = append(s.Fields, Field{Name: fmt.Sprintf("status-%d", i), Type: "uint8"})
+	}
+	for i := 1; i <= 2; i++ {
+		s.Fields = append(s.Fields, Field{Name: fmt.Sprintf("value-%d", i), Type: "int64"})
+	}
+	return &s
+}
+
+func scienceData() *Schema {
+	s := Schema{
+		FCC:    string(panda.MMA),
+		Endian: "big",
+		Fields: []Field{
+			{Name: "time", Type: TypeTime},
+			{Name: "record", Type: TypeIndex, Offset: 1},
+			// the number of records has always been given in chunks of 32
+			// bytes while a record is 64 bytes long
+			{Name: "records", Type: TypeCount, Scale: 2},
+		},
+	}
+	for i := 1; i <= 32; i++ {
+		s.Fields = append(s.Fields, Field{Name: fmt.Sprintf("channel-%d", i), Type: "uint16"})
+	}
+	return &s
+}
+
+func svsData() *Schema {
+	return &Schema{
+		FCC:    string(panda.SVS),
+		Endian: "little",
+		Magic:  "90",
+		Skip:   74,
+		Header: true,
+		Repeat: "uint8",
+		Label:  "uint16",
+		Fields: []Field{
+			{Name: "t", Type: TypeIndex},
+			{Name: "g2(t, %d)", Type: "float32", Repeat: true},
+		},
+	}
+}
@@ -0,0 +1,244 @@
+package science
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/toml"
+)
+
+// Conversion gives the engineering value of the raw values of a column with a
+// polynomial (c0 + c1*x + c2*x^2...) or with a lookup table. Values between
+// two points of the table are interpolated linearly, values outside of the
+// table are given the value of the nearest point.
+type Conversion struct {
+	Name       string    `toml:"name"`
+	Unit       string    `toml:"unit"`
+	Polynomial []float64 `toml:"polynomial"`
+	Raw        []float64 `toml:"raw"`
+	Values     []float64 `toml:"values"`
+}
+
+func (c Conversion) Apply(x float64) float64 {
+	if len(c.Raw) == 0 {
+		var v float64
+		for i := len(c.Polynomial) - 1; i >= 0; i-- {
+			v = v*x + c.Polynomial[i]
+		}
+		return v
+	}
+	n := len(c.Raw)
+	ix := sort.SearchFloat64s(c.Raw, x)
+	switch {
+	case ix == 0:
+		return c.Values[0]
+	case ix == n:
+		return c.Values[n-1]
+	}
+	x0, x1 := c.Raw[ix-1], c.Raw[ix]
+	y0, y1 := c.Values[ix-1], c.Values[ix]
+	return y0 + (x-x0)*(y1-y0)/(x1-x0)
+}
+
+func (c Conversion) check() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing column name")
+	}
+	if len(c.Raw) == 0 {
+		if len(c.Polynomial) == 0 {
+			return fmt.Errorf("%s: missing polynomial or table", c.Name)
+		}
+		return nil
+	}
+	if len(c.Polynomial) > 0 {
+		return fmt.Errorf("%s: both polynomial and table given", c.Name)
+	}
+	if len(c.Raw) != len(c.Values) {
+		return fmt.Errorf("%s: table with %d raw values and %d values", c.Name, len(c.Raw), len(c.Values))
+	}
+	for i := 1; i < len(c.Raw); i++ {
+		if c.Raw[i] <= c.Raw[i-1] {
+			return fmt.Errorf("%s: raw values of table not increasing", c.Name)
+		}
+	}
+	return nil
+}
+
+// Calibration gives the conversions of the columns of the products of a FCC
+// (and optionally of an origin) during a period (starts and ends are RFC3339
+// times, an empty bound means no limit). Calibrations are identified by their
+// name and their version.
+type Calibration struct {
+	Name    string       `toml:"name"`
+	Version string       `toml:"version"`
+	FCC     string       `toml:"fcc"`
+	Origin  string       `toml:"origin"`
+	Starts  string       `toml:"starts"`
+	Ends    string       `toml:"ends"`
+	Columns []Conversion `toml:"column"`
+
+	starts time.Time
+	ends   time.Time
+}
+
+func (c *Calibration) String() string {
+	return c.Name + "/" + c.Version
+}
+
+func (c *Calibration) check() error {
+	if c.Name == "" || c.Version == "" {
+		return fmt.Errorf("missing name or version")
+	}
+	if strings.TrimSpace(c.FCC) == "" {
+		return fmt.Errorf("missing fcc")
+	}
+	var err error
+	if c.Starts != "" {
+		if c.starts, err = time.Parse(time.RFC3339, c.Starts); err != nil {
+			return fmt.Errorf("invalid starts %s", c.Starts)
+		}
+	}
+	if c.Ends != "" {
+		if c.ends, err = time.Parse(time.RFC3339, c.Ends); err != nil {
+			return fmt.Errorf("invalid ends %s", c.Ends)
+		}
+	}
+	for _, v := range c.Columns {
+		if err := v.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Calibration) match(fcc, origin string, t time.Time) bool {
+	if strings.TrimSpace(c.FCC) != strings.TrimSpace(fcc) {
+		return false
+	}
+	if c.Origin != "" && c.Origin != origin {
+		return false
+	}
+	if !c.starts.IsZero() && t.Before(c.starts) {
+		return false
+	}
+	return c.ends.IsZero() || t.Before(c.ends)
+}
+
+// Apply replaces the raw values of the columns of t by their engineering
+// values.
+func (c *Calibration) Apply(t *Table) {
+	for _, v := range c.Columns {
+		for j := range t.Columns {
+			if t.Columns[j].Name != v.Name {
+				continue
+			}
+			t.Columns[j].Type, t.Columns[j].Unit = "float64", v.Unit
+			for _, r := range t.Rows {
+				if x, ok := toFloat(r[j]); ok {
+					r[j] = v.Apply(x)
+				}
+			}
+		}
+	}
+	t.Calibration = c.String()
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+type Calibrations []*Calibration
+
+// LoadCalibrations gives the calibrations found in the files of dir (one
+// calibration by file). A version of a calibration can only be defined once.
+func LoadCalibrations(dir string) (Calibrations, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	i, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !i.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", dir)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cs   Calibrations
+		seen = make(map[string]string)
+	)
+	for _, f := range files {
+		var c Calibration
+		if err := toml.DecodeFile(f, &c); err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		if err := c.check(); err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		if other, ok := seen[c.String()]; ok {
+			return nil, fmt.Errorf("%s: %s already defined in %s", f, c.String(), other)
+		}
+		seen[c.String()] = f
+		cs = append(cs, &c)
+	}
+	return cs, nil
+}
+
+// Find gives the calibration of the products of fcc and origin at t. When
+// version is empty, the calibration with the greatest version is given.
+// Calibrations of an origin take precedence over the ones of a FCC.
+func (cs Calibrations) Find(fcc, origin string, t time.Time, version string) (*Calibration, bool) {
+	var found *Calibration
+	for _, c := range cs {
+		if !c.match(fcc, origin, t) || (version != "" && c.Version != version) {
+			continue
+		}
+		switch {
+		case found == nil:
+			found = c
+		case (c.Origin != "") != (found.Origin != ""):
+			if c.Origin != "" {
+				found = c
+			}
+		case compareVersion(c.Version, found.Version) > 0:
+			found = c
+		}
+	}
+	return found, found != nil
+}
+
+// compareVersion compares versions numerically when both are numbers.
+func compareVersion(a, b string) int {
+	x, err1 := strconv.ParseFloat(a, 64)
+	y, err2 := strconv.ParseFloat(b, 64)
+	if err1 == nil && err2 == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
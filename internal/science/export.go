@@ -0,0 +1,112 @@
+package science
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// timed gives the columns and the rows of t with the time of the product as
+// first column when the schema of t doesn't have a time field.
+func (t *Table) timed() ([]Column, [][]interface{}) {
+	for _, c := range t.Columns {
+		if c.Type == TypeTime {
+			return t.Columns, t.Rows
+		}
+	}
+	cs := append([]Column{{Name: "time", Type: TypeTime}}, t.Columns...)
+	rs := make([][]interface{}, len(t.Rows))
+	for i, r := range t.Rows {
+		rs[i] = append([]interface{}{t.Time}, r...)
+	}
+	return cs, rs
+}
+
+// records is like timed but adds the calibration applied to the records as
+// a column when they are calibrated.
+func (t *Table) records() ([]Column, [][]interface{}) {
+	cs, rs := t.timed()
+	if t.Calibration == "" {
+		return cs, rs
+	}
+	cs = append(cs[:len(cs):len(cs)], Column{Name: "calibration", Type: "string"})
+	xs := make([][]interface{}, len(rs))
+	for i, r := range rs {
+		xs[i] = append(r[:len(r):len(r)], t.Calibration)
+	}
+	return cs, xs
+}
+
+// WriteJSON writes the records of t as an array of objects. Calibrated
+// records have the calibration applied as a field.
+func (t *Table) WriteJSON(w io.Writer) error {
+	ws := bufio.NewWriter(w)
+	cs, rs := t.records()
+	ws.WriteString("[")
+	for i, r := range rs {
+		if i > 0 {
+			ws.WriteString(",")
+		}
+		if err := writeRecord(ws, cs, r); err != nil {
+			return err
+		}
+	}
+	ws.WriteString("]\n")
+	return ws.Flush()
+}
+
+// WriteNDJSON writes the records of t as objects separated by newlines, like
+// WriteJSON.
+func (t *Table) WriteNDJSON(w io.Writer) error {
+	ws := bufio.NewWriter(w)
+	cs, rs := t.records()
+	for _, r := range rs {
+		if err := writeRecord(ws, cs, r); err != nil {
+			return err
+		}
+		ws.WriteString("\n")
+	}
+	return ws.Flush()
+}
+
+// writeRecord writes the values of a record in the order of the columns.
+// NaN and infinite values are written as null.
+func writeRecord(w *bufio.Writer, cs []Column, r []interface{}) error {
+	w.WriteString("{")
+	for i, c := range cs {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		k, err := json.Marshal(c.Name)
+		if err != nil {
+			return err
+		}
+		w.Write(k)
+		w.WriteString(":")
+
+		var v interface{}
+		switch x := r[i].(type) {
+		case float32:
+			if !math.IsNaN(float64(x)) && !math.IsInf(float64(x), 0) {
+				v = x
+			}
+		case float64:
+			if !math.IsNaN(x) && !math.IsInf(x, 0) {
+				v = x
+			}
+		case time.Time:
+			v = x.Format(time.RFC3339Nano)
+		default:
+			v = x
+		}
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		w.Write(bs)
+	}
+	w.WriteString("}")
+	return nil
+}
@@ -0,0 +1,269 @@
+package science
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// The Parquet files are written with a single row group and a single plain
+// encoded and uncompressed data page by column. All the columns are required.
+// Metadata are encoded with the compact protocol of Thrift.
+
+const parquetMagic = "PAR1"
+
+// physical and converted types, encodings and page types of the Parquet
+// format.
+const (
+	parquetInt64  = 2
+	parquetFloat  = 4
+	parquetDouble = 5
+
+	parquetTimestampMillis = 9
+	parquetUint64          = 14
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetRequired = 0
+	parquetDataPage = 0
+)
+
+// WriteParquet writes the records of t as a Parquet file. Integers are written
+// as INT64 (with the UINT_64 converted type for unsigned values) and times as
+// INT64 with the TIMESTAMP_MILLIS converted type. Units are given in the
+// key/value metadata of the file as <column>.unit and the calibration applied
+// to the records as calibration.
+func (t *Table) WriteParquet(w io.Writer) error {
+	cs, rs := t.timed()
+
+	var (
+		body   bytes.Buffer
+		chunks []*thrift
+		offset = int64(len(parquetMagic))
+	)
+	body.WriteString(parquetMagic)
+	for i, c := range cs {
+		kind, _ := parquetType(c.Type)
+
+		var data bytes.Buffer
+		for _, r := range rs {
+			writePlain(&data, kind, r[i])
+		}
+		page := new(thrift)
+		page.I32(1, parquetDataPage)
+		page.I32(2, int32(data.Len()))
+		page.I32(3, int32(data.Len()))
+		h := new(thrift)
+		h.I32(1, int32(len(rs)))
+		h.I32(2, parquetPlain)
+		h.I32(3, parquetRLE)
+		h.I32(4, parquetRLE)
+		h.Stop()
+		page.Struct(5, h)
+		page.Stop()
+
+		size := int64(page.Len() + data.Len())
+		page.WriteTo(&body)
+		data.WriteTo(&body)
+
+		m := new(thrift)
+		m.I32(1, kind)
+		m.List(2, thriftI32, 2)
+		m.Varint(parquetPlain)
+		m.Varint(parquetRLE)
+		m.List(3, thriftBinary, 1)
+		m.Binary(c.Name)
+		m.I32(4, 0)
+		m.I64(5, int64(len(rs)))
+		m.I64(6, size)
+		m.I64(7, size)
+		m.I64(9, offset)
+		m.Stop()
+
+		k := new(thrift)
+		k.I64(2, offset)
+		k.Struct(3, m)
+		k.Stop()
+		chunks = append(chunks, k)
+
+		offset += size
+	}
+
+	f := new(thrift)
+	f.I32(1, 1)
+	f.List(2, thriftStruct, len(cs)+1)
+	root := new(thrift)
+	root.String(4, "schema")
+	root.I32(5, int32(len(cs)))
+	root.Stop()
+	f.Write(root.Bytes())
+	for _, c := range cs {
+		kind, conv := parquetType(c.Type)
+		e := new(thrift)
+		e.I32(1, kind)
+		e.I32(3, parquetRequired)
+		e.String(4, c.Name)
+		if conv >= 0 {
+			e.I32(6, conv)
+		}
+		e.Stop()
+		f.Write(e.Bytes())
+	}
+	f.I64(3, int64(len(rs)))
+	f.List(4, thriftStruct, 1)
+	g := new(thrift)
+	g.List(1, thriftStruct, len(chunks))
+	for _, k := range chunks {
+		g.Write(k.Bytes())
+	}
+	g.I64(2, offset-int64(len(parquetMagic)))
+	g.I64(3, int64(len(rs)))
+	g.Stop()
+	f.Write(g.Bytes())
+
+	var kvs [][2]string
+	for _, c := range cs {
+		if c.Unit != "" {
+			kvs = append(kvs, [2]string{c.Name + ".unit", c.Unit})
+		}
+	}
+	if t.Calibration != "" {
+		kvs = append(kvs, [2]string{"calibration", t.Calibration})
+	}
+	if len(kvs) > 0 {
+		f.List(5, thriftStruct, len(kvs))
+		for _, v := range kvs {
+			kv := new(thrift)
+			kv.String(1, v[0])
+			kv.String(2, v[1])
+			kv.Stop()
+			f.Write(kv.Bytes())
+		}
+	}
+	f.String(6, "hadock")
+	f.Stop()
+
+	body.Write(f.Bytes())
+	binary.Write(&body, binary.LittleEndian, uint32(f.Len()))
+	body.WriteString(parquetMagic)
+	_, err := body.WriteTo(w)
+	return err
+}
+
+// parquetType gives the physical and the converted type (-1 if none) of the
+// values of a column.
+func parquetType(t string) (int32, int32) {
+	switch t {
+	case "float32":
+		return parquetFloat, -1
+	case "float64":
+		return parquetDouble, -1
+	case TypeTime:
+		return parquetInt64, parquetTimestampMillis
+	case "uint8", "uint16", "uint32", "uint64":
+		return parquetInt64, parquetUint64
+	default:
+		return parquetInt64, -1
+	}
+}
+
+func writePlain(w *bytes.Buffer, kind int32, v interface{}) {
+	switch kind {
+	case parquetFloat:
+		x, _ := v.(float32)
+		binary.Write(w, binary.LittleEndian, math.Float32bits(x))
+	case parquetDouble:
+		x, _ := v.(float64)
+		binary.Write(w, binary.LittleEndian, math.Float64bits(x))
+	default:
+		var x int64
+		switch v := v.(type) {
+		case int64:
+			x = v
+		case uint64:
+			x = int64(v)
+		case time.Time:
+			x = v.UnixNano() / int64(time.Millisecond)
+		}
+		binary.Write(w, binary.LittleEndian, x)
+	}
+}
+
+// types of the compact protocol of Thrift
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thrift encodes a struct with the compact protocol of Thrift. Fields should
+// be given in increasing order of their ids.
+type thrift struct {
+	bytes.Buffer
+	last int16
+}
+
+func (t *thrift) field(id int16, kind byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.WriteByte(byte(d)<<4 | kind)
+	} else {
+		t.WriteByte(kind)
+		t.Varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thrift) Varint(v int64) {
+	bs := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(bs, v)
+	t.Write(bs[:n])
+}
+
+func (t *thrift) I32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.Varint(int64(v))
+}
+
+func (t *thrift) I64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.Varint(v)
+}
+
+func (t *thrift) String(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.Binary(v)
+}
+
+func (t *thrift) Binary(v string) {
+	bs := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(bs, uint64(len(v)))
+	t.Write(bs[:n])
+	t.WriteString(v)
+}
+
+func (t *thrift) Struct(id int16, s *thrift) {
+	t.field(id, thriftStruct)
+	t.Write(s.Bytes())
+}
+
+// List writes the header of a list of n elements. The elements are written
+// by the caller.
+func (t *thrift) List(id int16, kind byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | kind)
+	} else {
+		t.WriteByte(0xF0 | kind)
+		bs := make([]byte, binary.MaxVarintLen64)
+		t.Write(bs[:binary.PutUvarint(bs, uint64(n))])
+	}
+}
+
+func (t *thrift) Stop() {
+	t.WriteByte(0)
+}
@@ -0,0 +1,297 @@
+package science
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func parquetTable() Table {
+	return Table{
+		Time:        time.Date(2019, 5, 17, 12, 30, 15, 250*int(time.Millisecond), time.UTC),
+		Calibration: "sensors/2",
+		Columns: []Column{
+			{Name: "index", Type: "int64"},
+			{Name: "counter", Type: "uint16"},
+			{Name: "voltage", Type: "float32", Unit: "V"},
+			{Name: "temperature", Type: "float64", Unit: "degC"},
+		},
+		Rows: [][]interface{}{
+			{int64(0), uint64(10), float32(1.5), float64(-20.25)},
+			{int64(1), uint64(65535), float32(-3), float64(1e6)},
+			{int64(2), uint64(0), float32(0.125), math.Inf(1)},
+		},
+	}
+}
+
+// TestReadParquet checks that the files written by WriteParquet can be read
+// by the reader of parquet-go.
+func TestReadParquet(t *testing.T) {
+	tb := parquetTable()
+	var w bytes.Buffer
+	if err := tb.WriteParquet(&w); err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(w.Bytes()), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	n := pr.GetNumRows()
+	if n != int64(len(tb.Rows)) {
+		t.Fatalf("rows: want %d, got %d", len(tb.Rows), n)
+	}
+	millis := tb.Time.UnixNano() / int64(time.Millisecond)
+	for i := 0; i <= len(tb.Columns); i++ {
+		vs, _, _, err := pr.ReadColumnByIndex(int64(i), n)
+		if err != nil {
+			t.Fatalf("column %d: %s", i, err)
+		}
+		if len(vs) != len(tb.Rows) {
+			t.Fatalf("column %d: want %d values, got %d", i, len(tb.Rows), len(vs))
+		}
+		for j, v := range vs {
+			var want interface{} = millis
+			if i > 0 {
+				want = tb.Rows[j][i-1]
+			}
+			if u, ok := want.(uint64); ok {
+				want = int64(u)
+			}
+			if v != want {
+				t.Errorf("column %d, row %d: want %v, got %v", i, j, want, v)
+			}
+		}
+	}
+	kvs := make(map[string]string)
+	for _, kv := range pr.Footer.KeyValueMetadata {
+		if kv.Value != nil {
+			kvs[kv.Key] = *kv.Value
+		}
+	}
+	if v := kvs["calibration"]; v != tb.Calibration {
+		t.Errorf("calibration: want %s, got %s", tb.Calibration, v)
+	}
+}
+
+func TestWriteParquet(t *testing.T) {
+	tb := parquetTable()
+	when := tb.Time
+	var w bytes.Buffer
+	if err := tb.WriteParquet(&w); err != nil {
+		t.Fatal(err)
+	}
+	bs := w.Bytes()
+	if !bytes.HasPrefix(bs, []byte(parquetMagic)) || !bytes.HasSuffix(bs, []byte(parquetMagic)) {
+		t.Fatalf("magic not found")
+	}
+	size := int(binary.LittleEndian.Uint32(bs[len(bs)-8:]))
+	if size <= 0 || size > len(bs)-12 {
+		t.Fatalf("invalid footer length %d", size)
+	}
+	footer := bs[len(bs)-8-size : len(bs)-8]
+	r := bytes.NewReader(footer)
+	meta, err := readCompact(r)
+	if err != nil {
+		t.Fatalf("decoding metadata: %s", err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left after the metadata", r.Len())
+	}
+	if v := meta[3]; v != int64(len(tb.Rows)) {
+		t.Errorf("num_rows: want %d, got %v", len(tb.Rows), v)
+	}
+
+	want := []struct {
+		Name string
+		Type int64
+		Conv int64
+	}{
+		{Name: "time", Type: parquetInt64, Conv: parquetTimestampMillis},
+		{Name: "index", Type: parquetInt64, Conv: -1},
+		{Name: "counter", Type: parquetInt64, Conv: parquetUint64},
+		{Name: "voltage", Type: parquetFloat, Conv: -1},
+		{Name: "temperature", Type: parquetDouble, Conv: -1},
+	}
+	schema, _ := meta[2].([]interface{})
+	if len(schema) != len(want)+1 {
+		t.Fatalf("schema: want %d elements, got %d", len(want)+1, len(schema))
+	}
+	if root := schema[0].(map[int16]interface{}); root[5] != int64(len(want)) {
+		t.Errorf("root: want %d children, got %v", len(want), root[5])
+	}
+	for i, w := range want {
+		e := schema[i+1].(map[int16]interface{})
+		conv, ok := e[6]
+		if !ok {
+			conv = int64(-1)
+		}
+		if e[4] != w.Name || e[1] != w.Type || conv != w.Conv || e[3] != int64(parquetRequired) {
+			t.Errorf("column %d: want %+v, got %v", i, w, e)
+		}
+	}
+
+	groups, _ := meta[4].([]interface{})
+	if len(groups) != 1 {
+		t.Fatalf("want 1 row group, got %d", len(groups))
+	}
+	chunks, _ := groups[0].(map[int16]interface{})[1].([]interface{})
+	if len(chunks) != len(want) {
+		t.Fatalf("want %d column chunks, got %d", len(want), len(chunks))
+	}
+	var values [][]interface{}
+	for i, c := range chunks {
+		m := c.(map[int16]interface{})[3].(map[int16]interface{})
+		if m[5] != int64(len(tb.Rows)) {
+			t.Errorf("column %d: want %d values, got %v", i, len(tb.Rows), m[5])
+		}
+		offset, _ := m[9].(int64)
+		r := bytes.NewReader(bs[offset:])
+		page, err := readCompact(r)
+		if err != nil {
+			t.Fatalf("column %d: decoding page header: %s", i, err)
+		}
+		if page[1] != int64(parquetDataPage) {
+			t.Fatalf("column %d: not a data page: %v", i, page[1])
+		}
+		data := make([]byte, page[3].(int64))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatalf("column %d: reading page: %s", i, err)
+		}
+		var vs []interface{}
+		for len(data) > 0 {
+			switch want[i].Type {
+			case parquetFloat:
+				vs = append(vs, math.Float32frombits(binary.LittleEndian.Uint32(data)))
+				data = data[4:]
+			case parquetDouble:
+				vs = append(vs, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+				data = data[8:]
+			default:
+				vs = append(vs, int64(binary.LittleEndian.Uint64(data)))
+				data = data[8:]
+			}
+		}
+		values = append(values, vs)
+	}
+	for j, row := range tb.Rows {
+		if v := values[0][j]; v != when.UnixNano()/int64(time.Millisecond) {
+			t.Errorf("row %d: time: want %d, got %v", j, when.UnixNano()/int64(time.Millisecond), v)
+		}
+		for i, v := range row {
+			if u, ok := v.(uint64); ok {
+				v = int64(u)
+			}
+			if got := values[i+1][j]; got != v {
+				t.Errorf("row %d: %s: want %v, got %v", j, want[i+1].Name, v, got)
+			}
+		}
+	}
+
+	kvs := make(map[string]string)
+	if ms, ok := meta[5].([]interface{}); ok {
+		for _, m := range ms {
+			kv := m.(map[int16]interface{})
+			kvs[kv[1].(string)] = kv[2].(string)
+		}
+	}
+	if v := kvs["calibration"]; v != tb.Calibration {
+		t.Errorf("calibration: want %s, got %s", tb.Calibration, v)
+	}
+	for _, c := range tb.Columns {
+		if c.Unit != "" && kvs[c.Name+".unit"] != c.Unit {
+			t.Errorf("%s: want unit %s, got %s", c.Name, c.Unit, kvs[c.Name+".unit"])
+		}
+	}
+}
+
+// readCompact decodes a struct encoded with the compact protocol of Thrift.
+// Fields are given by their ids: integers as int64, binaries as string, lists
+// as []interface{} and structs as map[int16]interface{}.
+func readCompact(r *bytes.Reader) (map[int16]interface{}, error) {
+	s := make(map[int16]interface{})
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+		switch kind := b & 0x0F; kind {
+		case 1, 2:
+			s[id] = kind == 1
+		default:
+			if s[id], err = readCompactValue(r, kind); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readCompactValue(r *bytes.Reader, kind byte) (interface{}, error) {
+	switch kind {
+	case 1, 2:
+		b, err := r.ReadByte()
+		return b == 1, err
+	case 3:
+		b, err := r.ReadByte()
+		return int64(int8(b)), err
+	case 4, thriftI32, thriftI64:
+		return binary.ReadVarint(r)
+	case 7:
+		var f float64
+		err := binary.Read(r, binary.LittleEndian, &f)
+		return f, err
+	case thriftBinary:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		bs := make([]byte, n)
+		_, err = io.ReadFull(r, bs)
+		return string(bs), err
+	case thriftList:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(b >> 4)
+		if n == 15 {
+			if n, err = binary.ReadUvarint(r); err != nil {
+				return nil, err
+			}
+		}
+		vs := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := readCompactValue(r, b&0x0F)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+		}
+		return vs, nil
+	case thriftStruct:
+		return readCompact(r)
+	default:
+		return nil, fmt.Errorf("unsupported type %d", kind)
+	}
+}
@@ -0,0 +1,467 @@
+package science
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/toml"
+)
+
+var ErrMagic = errors.New("magic not found")
+
+// MaxRepeat is the largest number of repetitions of the fields of a record.
+const MaxRepeat = 4096
+
+// types of the fields that are not read from the records: the time of the
+// product, the position of the record in the product and the number of
+// records of the product.
+const (
+	TypeTime  = "time"
+	TypeIndex = "index"
+	TypeCount = "count"
+)
+
+var sizes = map[string]int{
+	"int8":    1,
+	"uint8":   1,
+	"int16":   2,
+	"uint16":  2,
+	"int32":   4,
+	"uint32":  4,
+	"float32": 4,
+	"int64":   8,
+	"uint64":  8,
+	"float64": 8,
+	TypeTime:  0,
+	TypeIndex: 0,
+	TypeCount: 0,
+}
+
+// Field describes a column of the records of a product. Values are scaled
+// (value*scale + offset) when scale or offset is set. The name of repeated
+// fields is formatted with the label read for each repetition.
+type Field struct {
+	Name   string  `toml:"name"`
+	Type   string  `toml:"type"`
+	Endian string  `toml:"endian"`
+	Scale  float64 `toml:"scale"`
+	Offset float64 `toml:"offset"`
+	Unit   string  `toml:"unit"`
+	Repeat bool    `toml:"repeat"`
+}
+
+func (f Field) scaled() bool {
+	return (f.Scale != 0 && f.Scale != 1) || f.Offset != 0
+}
+
+// Schema describes the layout of the records of the science products of a
+// FCC (and optionally of an origin).
+//
+// Products can start with a magic (hex encoded) followed by skip bytes. When
+// repeat is set, the number of repeated fields is read with this type after
+// the skipped bytes then a label of type label is read for each repetition.
+// The size of a record is computed from its fields unless record is set.
+type Schema struct {
+	FCC    string  `toml:"fcc"`
+	Origin string  `toml:"origin"`
+	Endian string  `toml:"endian"`
+	Magic  string  `toml:"magic"`
+	Skip   int     `toml:"skip"`
+	Record int     `toml:"record"`
+	Header bool    `toml:"header"`
+	Repeat string  `toml:"repeat"`
+	Label  string  `toml:"label"`
+	Fields []Field `toml:"field"`
+}
+
+func (s *Schema) Key() string {
+	return schemaKey(s.FCC, s.Origin)
+}
+
+func schemaKey(fcc, origin string) string {
+	k := strings.TrimSpace(fcc)
+	if origin != "" {
+		k += "/" + origin
+	}
+	return k
+}
+
+func (s *Schema) check() error {
+	if strings.TrimSpace(s.FCC) == "" {
+		return fmt.Errorf("missing fcc")
+	}
+	if _, err := hex.DecodeString(s.Magic); err != nil {
+		return fmt.Errorf("invalid magic %s", s.Magic)
+	}
+	if _, err := byteOrder(s.Endian); err != nil {
+		return err
+	}
+	for _, t := range []string{s.Repeat, s.Label} {
+		if n, ok := sizes[t]; t != "" && (!ok || n == 0 || strings.HasPrefix(t, "float")) {
+			return fmt.Errorf("invalid repeat type %s", t)
+		}
+	}
+	var size int
+	for _, f := range s.Fields {
+		n, ok := sizes[f.Type]
+		if !ok {
+			return fmt.Errorf("%s: unknown type %s", f.Name, f.Type)
+		}
+		if _, err := byteOrder(f.Endian); err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+		if f.Repeat && n == 0 {
+			return fmt.Errorf("%s: %s can not be repeated", f.Name, f.Type)
+		}
+		if f.Repeat && s.Repeat == "" {
+			return fmt.Errorf("%s: repeated field without repeat", f.Name)
+		}
+		size += n
+	}
+	if s.Record > 0 && s.Record < size {
+		return fmt.Errorf("record too short (%d < %d)", s.Record, size)
+	}
+	return nil
+}
+
+func byteOrder(e string) (binary.ByteOrder, error) {
+	switch strings.ToLower(e) {
+	case "", "big", "be":
+		return binary.BigEndian, nil
+	case "little", "le":
+		return binary.LittleEndian, nil
+	default:
+		return nil, fmt.Errorf("unknown endianness %s", e)
+	}
+}
+
+// Column is a field of a schema once its repetitions are expanded.
+type Column struct {
+	Name  string
+	Type  string
+	Unit  string
+	field Field
+	order binary.ByteOrder
+}
+
+// Table holds the records decoded from a product. Values are time.Time,
+// int64, uint64, float32 or float64 (for scaled fields).
+type Table struct {
+	Time    time.Time
+	Header  bool
+	Columns []Column
+	Rows    [][]interface{}
+
+	// Calibration is the name and the version of the calibration applied to
+	// the records.
+	Calibration string
+}
+
+// Decode gives the records found in bs. t is the time of the product.
+func (s *Schema) Decode(bs []byte, t time.Time) (*Table, error) {
+	magic, _ := hex.DecodeString(s.Magic)
+	if !bytes.HasPrefix(bs, magic) {
+		return nil, ErrMagic
+	}
+	order, _ := byteOrder(s.Endian)
+	if len(bs) < s.Skip {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r := bytes.NewReader(bs[s.Skip:])
+
+	var labels []interface{}
+	if s.Repeat != "" {
+		v, err := readValue(r, s.Repeat, order)
+		if err != nil {
+			return nil, err
+		}
+		// each repetition takes at least the size of its label and of the
+		// repeated fields of a record
+		width := sizes[s.Label]
+		for _, f := range s.Fields {
+			if f.Repeat {
+				width += sizes[f.Type]
+			}
+		}
+		if width == 0 {
+			width = 1
+		}
+		n := toInt(v)
+		if n < 0 || n > MaxRepeat || n > r.Len()/width {
+			return nil, fmt.Errorf("invalid repeat count %v (%d bytes left)", v, r.Len())
+		}
+		for i := 0; i < n; i++ {
+			if s.Label == "" {
+				labels = append(labels, i)
+				continue
+			}
+			v, err := readValue(r, s.Label, order)
+			if err != nil {
+				return nil, err
+			}
+			labels = append(labels, v)
+		}
+	}
+	tb := Table{Time: t, Header: s.Header}
+	var size int
+	for _, f := range s.Fields {
+		o := order
+		if f.Endian != "" {
+			o, _ = byteOrder(f.Endian)
+		}
+		c := Column{Name: f.Name, Type: f.Type, Unit: f.Unit, field: f, order: o}
+		switch {
+		case f.Type == TypeIndex || f.Type == TypeCount:
+			c.Type = "int64"
+		case f.scaled():
+			c.Type = "float64"
+		}
+		if !f.Repeat {
+			tb.Columns = append(tb.Columns, c)
+			size += sizes[f.Type]
+			continue
+		}
+		for _, v := range labels {
+			x := c
+			if strings.Contains(f.Name, "%") {
+				x.Name = fmt.Sprintf(f.Name, v)
+			}
+			tb.Columns = append(tb.Columns, x)
+			size += sizes[f.Type]
+		}
+	}
+	if s.Record > size {
+		size = s.Record
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("empty record")
+	}
+	count := r.Len() / size
+	for i := 0; r.Len() > 0; i++ {
+		var (
+			row = make([]interface{}, len(tb.Columns))
+			pos = r.Len()
+		)
+		for j, c := range tb.Columns {
+			var (
+				v   interface{}
+				err error
+			)
+			switch c.field.Type {
+			case TypeTime:
+				v = t
+			case TypeIndex:
+				v = int64(i)
+			case TypeCount:
+				v = int64(count)
+			default:
+				v, err = readValue(r, c.field.Type, c.order)
+			}
+			if err != nil {
+				return nil, err
+			}
+			row[j] = scale(c.field, v)
+		}
+		// skip the padding of the record
+		if n := size - (pos - r.Len()); n > 0 {
+			if r.Len() < n {
+				return nil, io.ErrUnexpectedEOF
+			}
+			r.Seek(int64(n), io.SeekCurrent)
+		}
+		tb.Rows = append(tb.Rows, row)
+	}
+	return &tb, nil
+}
+
+func readValue(r io.Reader, t string, order binary.ByteOrder) (interface{}, error) {
+	bs := make([]byte, sizes[t])
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, err
+	}
+	switch t {
+	case "int8":
+		return int64(int8(bs[0])), nil
+	case "uint8":
+		return uint64(bs[0]), nil
+	case "int16":
+		return int64(int16(order.Uint16(bs))), nil
+	case "uint16":
+		return uint64(order.Uint16(bs)), nil
+	case "int32":
+		return int64(int32(order.Uint32(bs))), nil
+	case "uint32":
+		return uint64(order.Uint32(bs)), nil
+	case "int64":
+		return int64(order.Uint64(bs)), nil
+	case "uint64":
+		return order.Uint64(bs), nil
+	case "float32":
+		return math.Float32frombits(order.Uint32(bs)), nil
+	case "float64":
+		return math.Float64frombits(order.Uint64(bs)), nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", t)
+	}
+}
+
+func toInt(v interface{}) int {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func scale(f Field, v interface{}) interface{} {
+	if !f.scaled() {
+		return v
+	}
+	var x float64
+	switch v := v.(type) {
+	case int64:
+		x = float64(v)
+	case uint64:
+		x = float64(v)
+	case float32:
+		x = float64(v)
+	case float64:
+		x = v
+	default:
+		return v
+	}
+	s := f.Scale
+	if s == 0 {
+		s = 1
+	}
+	x = x*s + f.Offset
+	if f.Type == TypeIndex || f.Type == TypeCount {
+		return int64(math.Round(x))
+	}
+	return x
+}
+
+func FormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Export writes the records of bs as CSV. Products that don't start with the
+// magic of the schema are written as is.
+func (s *Schema) Export(w io.Writer, bs []byte, t time.Time) error {
+	tb, err := s.Decode(bs, t)
+	if err == ErrMagic {
+		_, err = w.Write(bs)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return tb.WriteCSV(w)
+}
+
+// WriteCSV writes the records of t as CSV. The calibration applied to the
+// records is given in a comment before them.
+func (t *Table) WriteCSV(w io.Writer) error {
+	if t.Calibration != "" {
+		if _, err := fmt.Fprintf(w, "# calibration: %s\n", t.Calibration); err != nil {
+			return err
+		}
+	}
+	c := csv.NewWriter(w)
+	vs := make([]string, len(t.Columns))
+	if t.Header {
+		for i, c := range t.Columns {
+			vs[i] = c.Name
+			if c.Unit != "" {
+				vs[i] += " (" + c.Unit + ")"
+			}
+		}
+		c.Write(vs)
+	}
+	for _, r := range t.Rows {
+		for i, v := range r {
+			vs[i] = FormatValue(v)
+		}
+		if err := c.Write(vs); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// Schemas gives the schema of a product from its FCC and its origin.
+type Schemas map[string]*Schema
+
+// Load gives the builtin schemas and the ones found in the files of dir (one
+// schema by file). Schemas of dir replace the builtin schemas with the same
+// FCC and origin.
+func Load(dir string) (Schemas, error) {
+	s := Builtin()
+	if dir == "" {
+		return s, nil
+	}
+	i, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !i.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", dir)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c, err := loadSchema(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		s[c.Key()] = c
+	}
+	return s, nil
+}
+
+func loadSchema(file string) (*Schema, error) {
+	var s Schema
+	if err := toml.DecodeFile(file, &s); err != nil {
+		return nil, err
+	}
+	return &s, s.check()
+}
+
+// Lookup gives the schema of the origin for fcc if any or the schema of fcc.
+func (s Schemas) Lookup(fcc, origin string) (*Schema, bool) {
+	if c, ok := s[schemaKey(fcc, origin)]; ok && origin != "" {
+		return c, ok
+	}
+	c, ok := s[schemaKey(fcc, "")]
+	return c, ok
+}
@@ -0,0 +1,178 @@
+package science
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrColumns = errors.New("columns mismatch")
+
+// Series writes the records of several tables as a single series. The columns
+// of the series are given by the first table written; tables with other
+// columns are rejected with ErrColumns. Records are flushed after each table.
+type Series interface {
+	Write(*Table) error
+	// Gap marks that no records are available between starts and ends.
+	Gap(starts, ends time.Time) error
+	Close() error
+}
+
+// NewCSVSeries gives a series written as CSV with a header. A gap is written
+// as a row with only the time of its start. The calibration applied to the
+// records is given in a comment each time it changes.
+func NewCSVSeries(w io.Writer) Series {
+	return &csvSeries{raw: w, writer: csv.NewWriter(w)}
+}
+
+// NewJSONSeries gives a series written as NDJSON or as an array of JSON
+// objects. A gap is written as an object with the time of its start, a gap
+// field set to true and the time of its end (until). Calibrated records have
+// the calibration applied as a field.
+func NewJSONSeries(w io.Writer, array bool) Series {
+	return &jsonSeries{writer: bufio.NewWriter(w), array: array}
+}
+
+type columns []Column
+
+func (cs columns) same(os []Column) bool {
+	if len(cs) != len(os) {
+		return false
+	}
+	for i := range cs {
+		if cs[i].Name != os[i].Name || cs[i].Unit != os[i].Unit {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs columns) time() int {
+	for i, c := range cs {
+		if c.Type == TypeTime {
+			return i
+		}
+	}
+	return 0
+}
+
+type csvSeries struct {
+	raw         io.Writer
+	writer      *csv.Writer
+	columns     columns
+	calibration string
+}
+
+func (s *csvSeries) Write(t *Table) error {
+	cs, rs := t.timed()
+	if t.Calibration != "" && t.Calibration != s.calibration {
+		s.calibration = t.Calibration
+		if _, err := fmt.Fprintf(s.raw, "# calibration: %s\n", t.Calibration); err != nil {
+			return err
+		}
+	}
+	if s.columns == nil {
+		s.columns = cs
+		vs := make([]string, len(cs))
+		for i, c := range cs {
+			vs[i] = c.Name
+			if c.Unit != "" {
+				vs[i] += " (" + c.Unit + ")"
+			}
+		}
+		s.writer.Write(vs)
+	} else if !s.columns.same(cs) {
+		return ErrColumns
+	}
+	vs := make([]string, len(cs))
+	for _, r := range rs {
+		for i, v := range r {
+			vs[i] = FormatValue(v)
+		}
+		s.writer.Write(vs)
+	}
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *csvSeries) Gap(starts, _ time.Time) error {
+	if s.columns == nil {
+		return nil
+	}
+	vs := make([]string, len(s.columns))
+	vs[s.columns.time()] = FormatValue(starts)
+	s.writer.Write(vs)
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *csvSeries) Close() error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+type jsonSeries struct {
+	writer  *bufio.Writer
+	array   bool
+	count   int
+	columns columns
+}
+
+func (s *jsonSeries) Write(t *Table) error {
+	cs, rs := t.records()
+	if s.columns == nil {
+		s.columns = cs
+	} else if !s.columns.same(cs) {
+		return ErrColumns
+	}
+	for _, r := range rs {
+		s.separate()
+		if err := writeRecord(s.writer, cs, r); err != nil {
+			return err
+		}
+	}
+	return s.writer.Flush()
+}
+
+func (s *jsonSeries) Gap(starts, ends time.Time) error {
+	if s.columns == nil {
+		return nil
+	}
+	c := s.columns[s.columns.time()]
+	cs := []Column{c, {Name: "gap"}, {Name: "until", Type: TypeTime}}
+	s.separate()
+	if err := writeRecord(s.writer, cs, []interface{}{starts, true, ends}); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+// separate writes the separator before a record.
+func (s *jsonSeries) separate() {
+	switch {
+	case !s.array:
+		if s.count > 0 {
+			s.writer.WriteString("\n")
+		}
+	case s.count == 0:
+		s.writer.WriteString("[")
+	default:
+		s.writer.WriteString(",")
+	}
+	s.count++
+}
+
+func (s *jsonSeries) Close() error {
+	switch {
+	case s.array && s.count == 0:
+		s.writer.WriteString("[]\n")
+	case s.array:
+		s.writer.WriteString("]\n")
+	case s.count > 0:
+		s.writer.WriteString("\n")
+	}
+	return s.writer.Flush()
+}
@@ -156,6 +156,18 @@ func (p *Pool) Notify(i *Item) {
 	}
 }
 
+// Alert sends m to all the notifiers without applying their filters: alerts
+// are not related to any instance, channel or source.
+func (p *Pool) Alert(m Message) {
+	for _, n := range p.notifiers {
+		if s, ok := n.(sender); ok {
+			go s.send(m)
+		} else {
+			go n.Notify(m)
+		}
+	}
+}
+
 func (p *Pool) notify(e time.Duration) {
 	type key struct {
 		Realtime bool
@@ -260,6 +272,10 @@ func NewExternalNotifier(p, a string, o *Options) (Notifier, error) {
 	return &notifier{conn: c, Options: o}, nil
 }
 
+type sender interface {
+	send(Message) error
+}
+
 type debugger struct {
 	*Options
 	*log.Logger
@@ -269,6 +285,10 @@ func (d *debugger) Notify(msg Message) error {
 	if err := d.Accept(msg); err != nil {
 		return nil
 	}
+	return d.send(msg)
+}
+
+func (d *debugger) send(msg Message) error {
 	rate := float64(msg.Count)
 	if secs := msg.Elapsed.Seconds(); secs > 0 {
 		rate = float64(msg.Count) / secs
@@ -298,6 +318,10 @@ func (n *notifier) Notify(m Message) error {
 	if err := n.Accept(m); err != nil {
 		return nil
 	}
+	return n.send(m)
+}
+
+func (n *notifier) send(m Message) error {
 	var (
 		buf bytes.Buffer
 		bs  []byte
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"image"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/busoc/hadock"
+	"github.com/busoc/hadock/internal/cache"
+	img "github.com/busoc/hadock/internal/image"
+	"github.com/busoc/hadock/storage"
+	"github.com/busoc/panda"
+	"github.com/midbel/toml"
+)
+
+// variant is a converted image as it would be requested to distrib: a format
+// (png, jpeg, gif) and the query of the request (eg: thumbnail&stretch).
+type variant struct {
+	Format string `toml:"format"`
+	Query  string `toml:"query"`
+
+	demosaic   img.Demosaic
+	roi        *img.ROI
+	transforms []img.Transform
+}
+
+type quicklook struct {
+	cache    *cache.Cache
+	variants []variant
+}
+
+func New(f string) (hadock.Module, error) {
+	r, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	c := struct {
+		Datadir  string    `toml:"datadir"`
+		Size     int       `toml:"cache-size"`
+		Variants []variant `toml:"variant"`
+	}{}
+	if err := toml.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	k, err := cache.New(c.Datadir, int64(c.Size)<<20)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Variants) == 0 {
+		c.Variants = []variant{{Format: "png"}, {Format: "png", Query: "thumbnail"}}
+	}
+	for i, v := range c.Variants {
+		switch v.Format = strings.ToLower(v.Format); v.Format {
+		case "jpg":
+			v.Format = "jpeg"
+		case "", "png", "jpeg", "gif":
+		default:
+			return nil, fmt.Errorf("unsupported format %s", v.Format)
+		}
+		if v.Format == "" {
+			v.Format = "png"
+		}
+		if v.transforms, err = img.Parse(v.Query); err != nil {
+			return nil, err
+		}
+		vs, err := url.ParseQuery(v.Query)
+		if err != nil {
+			return nil, err
+		}
+		if v.demosaic, err = img.ParseDemosaic(vs.Get("demosaic")); err != nil {
+			return nil, err
+		}
+		if _, ok := vs["roi"]; ok {
+			r, err := img.ParseROI(vs.Get("roi"))
+			if err != nil {
+				return nil, err
+			}
+			v.roi = &r
+		}
+		c.Variants[i] = v
+	}
+	q := quicklook{
+		cache:    k,
+		variants: c.Variants,
+	}
+	return &q, nil
+}
+
+func (q *quicklook) Process(_ uint8, p panda.HRPacket) error {
+	i, ok := p.(*panda.Image)
+	if !ok {
+		return nil
+	}
+	b, ok := i.IDH.(panda.Bitmap)
+	if !ok {
+		return nil
+	}
+	// the key of the cache is computed on the content of the file written by
+	// the storage
+	var raw bytes.Buffer
+	if err := storage.EncodeRawPacket(&raw, p); err != nil {
+		return err
+	}
+	sum := fmt.Sprintf("%x", md5.Sum(raw.Bytes()))
+
+	// frames are decoded once by demosaic method requested by the variants
+	gs := make(map[img.Demosaic]image.Image)
+	for _, v := range q.variants {
+		g, ok := gs[v.demosaic]
+		if !ok {
+			var err error
+			if g, err = img.DecodeWith(b.FCC(), int(b.X()), int(b.Y()), p.Payload(), v.demosaic); err != nil {
+				return err
+			}
+			gs[v.demosaic] = g
+		}
+		if v.roi != nil {
+			r := *v.roi
+			r.Geometry = geometryOf(i)
+			g = r.Transform(g)
+		}
+		var w bytes.Buffer
+		if err := img.Encode(&w, img.Apply(g, v.transforms...), v.Format); err != nil {
+			return err
+		}
+		if err := q.cache.Put(cache.Key(sum, v.Format, v.Query), w.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func geometryOf(i *panda.Image) img.Geometry {
+	var g img.Geometry
+	h, ok := i.IDH.(*panda.IDHv2)
+	if !ok {
+		return g
+	}
+	g.Sensor = image.Pt(int(h.Pixels.X), int(h.Pixels.Y))
+	if h.Region.SizeX > 0 && h.Region.SizeY > 0 {
+		x, y := int(h.Region.OffsetX), int(h.Region.OffsetY)
+		g.Region = image.Rect(x, y, x+int(h.Region.SizeX), y+int(h.Region.SizeY))
+	}
+	return g
+}
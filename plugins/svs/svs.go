@@ -3,17 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/csv"
 	"encoding/xml"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
 	"time"
 
 	"github.com/busoc/hadock"
+	"github.com/busoc/hadock/internal/science"
 	"github.com/busoc/hadock/storage"
 	"github.com/busoc/panda"
 	"github.com/midbel/toml"
@@ -50,7 +48,9 @@ type metadata struct {
 }
 
 type converter struct {
-	dir storage.Directory
+	dir          storage.Directory
+	schema       *science.Schema
+	calibrations science.Calibrations
 }
 
 func New(f string) (hadock.Module, error) {
@@ -64,12 +64,22 @@ func New(f string) (hadock.Module, error) {
 		Epoch    string   `toml:"time"`
 		Interval int      `toml:"interval"`
 		Levels   []string `toml:"levels"`
+		Calibs   string   `toml:"calibrations"`
 	}{}
 	if err := toml.NewDecoder(r).Decode(&c); err != nil {
 		return nil, err
 	}
+	cs, err := science.LoadCalibrations(c.Calibs)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := science.Builtin().Lookup(string(panda.SVS), origin)
+	// packets are already selected by their origin
+	s.Magic = ""
 	conv := converter{
-		dir: storage.NewDirectory(c.Datadir, c.Epoch, c.Levels, c.Interval),
+		dir:          storage.NewDirectory(c.Datadir, c.Epoch, c.Levels, c.Interval),
+		schema:       s,
+		calibrations: cs,
 	}
 	return &conv, nil
 }
@@ -87,50 +97,28 @@ func (c *converter) Process(i uint8, p panda.HRPacket) error {
 	}
 	file := filepath.Join(dir, p.Filename())
 
-	rs := bytes.NewReader(p.Payload())
-	if err := c.processMeta(file, rs); err != nil {
+	if err := c.processMeta(file, bytes.NewReader(p.Payload())); err != nil {
 		return err
 	}
-	return c.processData(file, rs)
+	return c.processData(file, p.Payload(), p.Timestamp())
 }
 
-func (c *converter) processData(file string, rs *bytes.Reader) error {
-	w, err := os.Create(file + ".csv")
+// processData writes the records of the packet as CSV. Values are converted
+// to engineering values when a calibration is defined for the packet.
+func (c *converter) processData(file string, bs []byte, t time.Time) error {
+	tb, err := c.schema.Decode(bs, t)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
-
-	ws := csv.NewWriter(w)
-
-	b, err := rs.ReadByte()
+	if k, ok := c.calibrations.Find(c.schema.FCC, origin, t, ""); ok {
+		k.Apply(tb)
+	}
+	w, err := os.Create(file + ".csv")
 	if err != nil {
 		return err
 	}
-	vs := make([]string, int(b)+1)
-	vs[0] = "t"
-	for j := 0; j < int(b); j++ {
-		var v uint16
-		if err := binary.Read(rs, binary.LittleEndian, &v); err != nil {
-			return err
-		}
-		vs[j+1] = fmt.Sprintf("g2(t, %d)", v)
-	}
-	ws.Write(vs)
-	for i := 0; rs.Len() > 0; i++ {
-		vs[0] = strconv.Itoa(i)
-		for j := 0; j < int(b); j++ {
-			var v float32
-			if err := binary.Read(rs, binary.LittleEndian, &v); err != nil {
-				return err
-			}
-			vs[j+1] = strconv.FormatFloat(float64(v), 'f', -1, 32)
-		}
-		ws.Write(vs)
-	}
-
-	ws.Flush()
-	return ws.Error()
+	defer w.Close()
+	return tb.WriteCSV(w)
 }
 
 func (c *converter) processMeta(file string, r io.Reader) error {
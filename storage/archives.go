@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/busoc/hadock/catalog"
 	"github.com/busoc/panda"
 	"github.com/midbel/roll"
 )
@@ -20,13 +21,22 @@ type tarstore struct {
 	Control
 
 	options []roll.Option
-	datadir string
+	datadir *volume
 	tardir  Directory
+	meta    string
+	stats   bool
+	sums    *manifest
+	record  func(catalog.Entry)
 
 	mu     sync.Mutex
 	caches map[string]*roll.Roller
 }
 
+func (t *tarstore) Close() error {
+	t.reset()
+	return nil
+}
+
 func NewArchiveStorage(o Options) (Storage, error) {
 	i, err := os.Stat(o.Location)
 	if err != nil {
@@ -35,6 +45,23 @@ func NewArchiveStorage(o Options) (Storage, error) {
 	if !i.IsDir() {
 		return nil, fmt.Errorf("%s: not a directory", o.Location)
 	}
+	for _, f := range o.Fallback {
+		i, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if !i.IsDir() {
+			return nil, fmt.Errorf("%s: not a directory", f)
+		}
+	}
+	meta, err := metadataFormat(o.Meta)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := newManifest(o.Manifest)
+	if err != nil {
+		return nil, err
+	}
 	dm := NewDirectory("", o.Epoch, o.Levels, o.Interval)
 
 	options := []roll.Option{
@@ -44,9 +71,13 @@ func NewArchiveStorage(o Options) (Storage, error) {
 	}
 	t := tarstore{
 		Control: o.Control,
-		datadir: o.Location,
+		datadir: newVolume(o),
 		options: options,
 		tardir:  dm,
+		meta:    meta,
+		stats:   o.Statistics,
+		sums:    sums,
+		record:  o.Record,
 		caches:  make(map[string]*roll.Roller),
 	}
 	return &t, nil
@@ -56,69 +87,114 @@ func (t *tarstore) Store(i uint8, p panda.HRPacket) error {
 	if !t.Can(p) {
 		return nil
 	}
-	k := cacheKey(i, p)
-	w, ok := t.caches[k]
-	if !ok {
-		tb, err := roll.Roll(nextFunc(filepath.Join(t.datadir, k)), t.options...)
-		if err != nil {
-			return err
-		}
-		w = tb
-		t.mu.Lock()
-		t.caches[k] = w
-		t.mu.Unlock()
+	datadir, switched := t.datadir.Location()
+	if switched {
+		t.reset()
+	}
+	w, err := t.roller(datadir, cacheKey(i, p))
+	if err != nil {
+		return err
 	}
 	var buf bytes.Buffer
-	if err := encodeRawPacket(&buf, p); err != nil {
+	if err := EncodeRawPacket(&buf, p); err != nil {
 		return err
 	}
+	dir, _ := t.tardir.Prepare(i, p)
+	name := filepath.Join(dir, p.Filename())
 	before := func(w io.Writer) error {
-		dir, _ := t.tardir.Prepare(i, p)
 		h := tar.Header{
-			Name:    filepath.Join(dir, p.Filename()),
+			Name:    name,
 			Size:    int64(buf.Len()),
 			ModTime: p.Timestamp(),
 			Gid:     1000,
 			Uid:     1000,
 			Mode:    0644,
 		}
-		return w.(*tar.Writer).WriteHeader(&h)
+		return w.(*tarball).WriteHeader(&h)
 	}
-	if _, err := w.WriteData(buf.Bytes(), before, nil); err != nil {
+	after := func(w io.Writer) error {
+		tb := w.(*tarball)
+		record(t.record, i, p, buf.Len(), catalog.Location{Scheme: "tar", File: tb.file, Member: name})
+		return t.sums.Append(tb.manifest, name, buf.Bytes())
+	}
+	if _, err := w.WriteData(buf.Bytes(), before, after); err != nil {
 		return err
 	}
 	// if err := w.Write(&h, buf.Bytes()); err != nil {
 	// 	return err
 	// }
-	if p, ok := p.(*panda.Image); ok {
-		return t.storeMetadata(w, i, p)
+	return t.storeMetadata(w, i, p)
+}
+
+func (t *tarstore) roller(datadir, k string) (*roll.Roller, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w, ok := t.caches[k]; ok {
+		return w, nil
 	}
-	return nil
+	var ext string
+	if t.sums != nil {
+		ext = t.sums.Ext
+	}
+	w, err := roll.Roll(nextFunc(filepath.Join(datadir, k), ext), t.options...)
+	if err != nil {
+		return nil, err
+	}
+	t.caches[k] = w
+	return w, nil
 }
 
-func (t *tarstore) storeMetadata(w *roll.Roller, i uint8, p *panda.Image) error {
+func (t *tarstore) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, w := range t.caches {
+		w.Close()
+		delete(t.caches, k)
+	}
+}
+
+func (t *tarstore) storeMetadata(w *roll.Roller, i uint8, p panda.HRPacket) error {
 	var buf bytes.Buffer
-	if err := encodeMetadata(&buf, p); err != nil {
+	if err := encodeMetadata(&buf, i, p, t.meta, t.stats); err != nil {
 		return err
 	}
+	if buf.Len() == 0 {
+		return nil
+	}
 
+	dir, _ := t.tardir.Prepare(i, p)
+	name := filepath.Join(dir, p.Filename()+t.meta)
 	before := func(w io.Writer) error {
-		dir, _ := t.tardir.Prepare(i, p)
 		h := tar.Header{
-			Name:    filepath.Join(dir, p.Filename()+XML),
+			Name:    name,
 			Size:    int64(buf.Len()),
 			ModTime: p.Timestamp(),
 			Gid:     1000,
 			Uid:     1000,
 			Mode:    0644,
 		}
-		return w.(*tar.Writer).WriteHeader(&h)
+		return w.(*tarball).WriteHeader(&h)
 	}
-	_, err := w.WriteData(buf.Bytes(), before, nil)
+	_, err := w.WriteData(buf.Bytes(), before, t.appendManifest(name, buf.Bytes()))
 	return err
 }
 
-func nextFunc(base string) roll.NextFunc {
+func (t *tarstore) appendManifest(name string, bs []byte) func(io.Writer) error {
+	if t.sums == nil {
+		return nil
+	}
+	return func(w io.Writer) error {
+		return t.sums.Append(w.(*tarball).manifest, name, bs)
+	}
+}
+
+type tarball struct {
+	*tar.Writer
+	file     string
+	manifest string
+}
+
+func nextFunc(base, sum string) roll.NextFunc {
 	return func(i int, w time.Time) (io.WriteCloser, []io.Closer, error) {
 		year := fmt.Sprintf("%04d", w.Year())
 		doy := fmt.Sprintf("%03d", w.YearDay())
@@ -133,8 +209,14 @@ func nextFunc(base string) roll.NextFunc {
 		if err != nil {
 			return nil, nil, err
 		}
-		tw := tar.NewWriter(wc)
-		return tw, []io.Closer{wc}, nil
+		tw := tarball{
+			Writer: tar.NewWriter(wc),
+			file:   wc.Name(),
+		}
+		if sum != "" {
+			tw.manifest = tw.file + sum
+		}
+		return &tw, []io.Closer{wc}, nil
 	}
 }
 
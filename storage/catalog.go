@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"github.com/busoc/hadock/catalog"
+	"github.com/busoc/panda"
+)
+
+func EntryOf(p Product, size int64, l catalog.Location) catalog.Entry {
+	return catalog.Entry{
+		Instance:  p.Instance,
+		Channel:   p.Channel,
+		Type:      p.Type,
+		Realtime:  p.Realtime,
+		Origin:    p.Origin,
+		UPI:       p.UPI,
+		Sequence:  p.Sequence,
+		Format:    p.Format,
+		Size:      size,
+		Valid:     p.Valid,
+		VMU:       p.VMU,
+		ACQ:       p.ACQ,
+		Locations: []catalog.Location{l},
+	}
+}
+
+func record(fn func(catalog.Entry), i uint8, p panda.HRPacket, size int, l catalog.Location) {
+	if fn == nil {
+		return
+	}
+	x := productOf(i, p)
+	x.Valid = panda.Valid(p)
+	fn(EntryOf(x, int64(size), l))
+}
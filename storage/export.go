@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/busoc/hadock/catalog"
+	"github.com/busoc/hadock/vmu"
+	"github.com/busoc/panda"
+)
+
+// headers gives the secondary header of a product as written in its sidecar.
+type headers struct {
+	XMLName xml.Name     `xml:"metadata" json:"-"`
+	When    time.Time    `xml:"vmu,attr" json:"vmu"`
+	IDH     *panda.IDHv2 `xml:",omitempty" json:"idh,omitempty"`
+	SDH     *panda.SDHv2 `xml:",omitempty" json:"sdh,omitempty"`
+}
+
+// ReadPacket rebuilds the VMU packet of the product stored in file from its
+// raw content and the secondary header found in its sidecar. The channel and
+// the mode of the packet are not kept in the archive and are given by c and
+// realtime.
+func ReadPacket(file string, c panda.Channel, realtime bool) (vmu.Packet, error) {
+	var (
+		k vmu.Packet
+		h headers
+	)
+	if err := readHeaders(file, &h); err != nil {
+		return k, err
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return k, err
+	}
+	// fcc (4) + sequence (4) + acquisition (8) and dimension (4) of images
+	skip := 16
+	switch {
+	case h.IDH != nil:
+		k.Header, skip = h.IDH, skip+4
+	case h.SDH != nil:
+		k.Header = h.SDH
+	default:
+		return k, fmt.Errorf("%s: no secondary header in sidecar", file)
+	}
+	if len(bs) < skip {
+		return k, fmt.Errorf("%s: short product", file)
+	}
+	var (
+		seq  = binary.BigEndian.Uint32(bs[4:])
+		when = int64(binary.BigEndian.Uint64(bs[8:]))
+	)
+	// the format of the store is not kept in the catalog: products not
+	// written by the raw format do not start with the sequence of their name
+	// and the acquisition time of their header
+	if !isRaw(file, seq, when, h) {
+		return k, fmt.Errorf("%s: not a raw product", file)
+	}
+	k.VMUHeader = vmu.NewHeader(c, realtime, seq, h.When)
+	k.Payload = bs[skip:]
+	k.Generated = panda.AdjustGenerationTime(when)
+	return k, nil
+}
+
+func isRaw(file string, seq uint32, when int64, h headers) bool {
+	p, err := ParseFilename(file)
+	if err != nil || p.Sequence != seq {
+		return false
+	}
+	switch {
+	case h.IDH != nil:
+		return int64(h.IDH.Acquisition) == when
+	case h.SDH != nil:
+		return int64(h.SDH.Acquisition) == when
+	default:
+		return false
+	}
+}
+
+// xmlHeaders reads the info of the secondary headers as text since arrays
+// can not be decoded from XML. The info is given in hexadecimal by the
+// sidecars written since the text can not hold all its bytes.
+type xmlHeaders struct {
+	XMLName xml.Name  `xml:"metadata"`
+	When    time.Time `xml:"vmu,attr"`
+	Info    string    `xml:"info,attr"`
+	IDH     *struct {
+		*panda.IDHv2
+		Info string
+	} `xml:",omitempty"`
+	SDH *struct {
+		*panda.SDHv2
+		Info string
+	} `xml:",omitempty"`
+}
+
+// readHeaders reads the headers of the sidecar of file. JSON sidecars are
+// read first since they keep the info of the headers as is.
+func readHeaders(file string, h *headers) error {
+	for _, ext := range []string{JSON, XML} {
+		r, err := os.Open(file + ext)
+		if err != nil {
+			continue
+		}
+		defer r.Close()
+		if ext == JSON {
+			return json.NewDecoder(r).Decode(h)
+		}
+		var x xmlHeaders
+		if err := xml.NewDecoder(r).Decode(&x); err != nil {
+			return err
+		}
+		h.When = x.When
+		if x.IDH != nil && x.IDH.IDHv2 != nil {
+			h.IDH = x.IDH.IDHv2
+			if err := readInfo(h.IDH.Info[:], x.Info, x.IDH.Info); err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+		}
+		if x.SDH != nil && x.SDH.SDHv2 != nil {
+			h.SDH = x.SDH.SDHv2
+			if err := readInfo(h.SDH.Info[:], x.Info, x.SDH.Info); err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: no sidecar found", file)
+}
+
+// readInfo copies in info the info given in hexadecimal or, for the older
+// sidecars, as text. Bytes not allowed in XML (eg: the padding) are written
+// as replacement characters in the text: such info can not be read without
+// loss.
+func readInfo(info []byte, hexa, text string) error {
+	if hexa != "" {
+		bs, err := hex.DecodeString(hexa)
+		if err != nil || len(bs) != len(info) {
+			return fmt.Errorf("invalid info %s", hexa)
+		}
+		copy(info, bs)
+		return nil
+	}
+	if strings.ContainsRune(text, utf8.RuneError) || len(text) > len(info) {
+		return fmt.Errorf("info can not be read from the XML sidecar without loss")
+	}
+	copy(info, text)
+	return nil
+}
+
+// ParseChannel gives the channel from its name (vic1, vic2 or lrsd).
+func ParseChannel(v string) (panda.Channel, bool) {
+	switch strings.ToLower(v) {
+	case "vic1":
+		return panda.Video1, true
+	case "vic2":
+		return panda.Video2, true
+	case "lrsd":
+		return panda.Science, true
+	default:
+		return 0, false
+	}
+}
+
+// Export writes as HRDP packets the products of the catalog in file selected
+// by q and of channel c (all channels when zero) in the order of their
+// acquisition. The channel of products indexed from archives is unknown: it
+// is the channel of science data for sciences and c (or the first video
+// channel) for images. Products that can not be rebuilt (eg: not stored in
+// the raw format) are skipped. Export gives the number of packets written.
+func Export(w io.Writer, file string, q catalog.Query, c panda.Channel) (int, error) {
+	// the catalog stays locked while it is searched: products are read once
+	// the entries are collected
+	var es []catalog.Entry
+	err := catalog.Search(file, q, func(e catalog.Entry) error {
+		k := e.Channel
+		if k == 0 {
+			switch {
+			case e.Type == "sciences":
+				k = panda.Science
+			case c != 0:
+				k = c
+			default:
+				k = panda.Video1
+			}
+		}
+		if c != 0 && k != c {
+			return nil
+		}
+		e.Channel = k
+		es = append(es, e)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	catalog.Sort(es)
+
+	var n int
+	for _, e := range es {
+		var p string
+		for _, l := range e.Locations {
+			if l.Scheme == "file" {
+				p = l.File
+				break
+			}
+		}
+		if p == "" {
+			continue
+		}
+		x, err := ReadPacket(p, e.Channel, e.Realtime)
+		if err != nil {
+			log.Printf("export: %s", err)
+			continue
+		}
+		if err := vmu.Encode(w, x, true); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -9,12 +9,14 @@ import (
 	"path"
 	"strings"
 
+	"github.com/busoc/hadock/catalog"
 	"github.com/busoc/panda"
 )
 
 const (
-	BAD = ".bad"
-	XML = ".xml"
+	BAD  = ".bad"
+	XML  = ".xml"
+	JSON = ".json"
 )
 
 type filestore struct {
@@ -22,9 +24,13 @@ type filestore struct {
 
 	data   Directory
 	rembad bool
+	meta   string
+	stats  bool
+	sums   *manifest
+	record func(catalog.Entry)
 	encode func(io.Writer, panda.HRPacket) error
 
-	links []linkstore
+	links []linker
 }
 
 func NewLocalStorage(o Options) (Storage, error) {
@@ -35,23 +41,50 @@ func NewLocalStorage(o Options) (Storage, error) {
 	if !i.IsDir() {
 		return nil, fmt.Errorf("%s: not a directory", o.Location)
 	}
-	dm := NewDirectory(o.Location, o.Epoch, o.Levels, o.Interval)
+	meta, err := metadataFormat(o.Meta)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := newManifest(o.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range o.Fallback {
+		i, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if !i.IsDir() {
+			return nil, fmt.Errorf("%s: not a directory", f)
+		}
+	}
+	dm := dirmaker{
+		Levels:   checkLevels(o.Levels, []string{LevelClassic, LevelVMUTime}),
+		Base:     o.Location,
+		Time:     o.Epoch,
+		Interval: o.Interval,
+		volume:   newVolume(o),
+	}
 
 	s := filestore{
 		Control: o.Control,
 		rembad:  !o.KeepBad,
-		data:    dm,
+		meta:    meta,
+		stats:   o.Statistics,
+		sums:    sums,
+		record:  o.Record,
+		data:    &dm,
 	}
 	for _, o := range o.Shares {
-		k, err := newLinkStorage(*o)
+		k, err := newShare(*o)
 		if err != nil {
 			return nil, err
 		}
-		s.links = append(s.links, *k)
+		s.links = append(s.links, k)
 	}
 	switch o.Format {
 	case "raw":
-		s.encode = encodeRawPacket
+		s.encode = EncodeRawPacket
 	default:
 		s.encode = func(w io.Writer, p panda.HRPacket) error {
 			return p.Export(w, "")
@@ -82,42 +115,79 @@ func (f *filestore) Store(i uint8, p panda.HRPacket) error {
 	}
 
 	if f.rembad {
-		os.Remove(path.Join(dir, badname))
+		f.removeBad(dir, badname, badname+f.meta)
 	}
 	file := path.Join(dir, filename)
 	if err := ioutil.WriteFile(file, w.Bytes(), 0644); err != nil {
 		return err
 	}
+	if err := f.appendManifest(dir, filename, w.Bytes()); err != nil {
+		return err
+	}
+	record(f.record, i, p, w.Len(), catalog.Location{Scheme: "file", File: file})
 	if err := f.linkToShare(file, i, p); err != nil {
 		return err
 	}
-	if p, ok := p.(*panda.Image); ok {
-		return f.writeMetadata(dir, i, p)
+	return f.writeMetadata(dir, i, p)
+}
+
+func (f *filestore) Close() error {
+	var err error
+	for _, k := range f.links {
+		if c, ok := k.(io.Closer); ok {
+			if e := c.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
 	}
-	return nil
+	return err
 }
 
-func (f *filestore) writeMetadata(dir string, i uint8, p *panda.Image) error {
+func (f *filestore) writeMetadata(dir string, i uint8, p panda.HRPacket) error {
 	var w bytes.Buffer
-	if err := encodeMetadata(&w, p); err != nil {
+	if err := encodeMetadata(&w, i, p, f.meta, f.stats); err != nil {
 		return err
 	}
 	if w.Len() == 0 {
 		return nil
 	}
 
-	filename := p.Filename() + XML
+	filename := p.Filename() + f.meta
 	badname := filename + BAD
 	if !p.IsRealtime() && f.rembad {
-		os.Remove(path.Join(dir, badname))
+		f.removeBad(dir, badname)
 	}
 	file := path.Join(dir, filename)
 	if err := ioutil.WriteFile(file, w.Bytes(), 0644); err != nil {
 		return err
 	}
+	if err := f.appendManifest(dir, filename, w.Bytes()); err != nil {
+		return err
+	}
 	return f.linkToShare(file, i, p)
 }
 
+// removeBad removes the superseded files of dir given by names and their
+// lines from the manifest.
+func (f *filestore) removeBad(dir string, names ...string) {
+	var gone []string
+	for _, n := range names {
+		if os.Remove(path.Join(dir, n)) == nil {
+			gone = append(gone, n)
+		}
+	}
+	if len(gone) > 0 && f.sums != nil {
+		f.sums.Remove(path.Join(dir, MANIFEST+f.sums.Ext), gone...)
+	}
+}
+
+func (f *filestore) appendManifest(dir, filename string, bs []byte) error {
+	if f.sums == nil {
+		return nil
+	}
+	return f.sums.Append(path.Join(dir, MANIFEST+f.sums.Ext), filename, bs)
+}
+
 func (f *filestore) linkToShare(link string, i uint8, p panda.HRPacket) error {
 	for _, s := range f.links {
 		if err := s.Link(link, i, p); err != nil {
@@ -127,6 +197,23 @@ func (f *filestore) linkToShare(link string, i uint8, p panda.HRPacket) error {
 	return nil
 }
 
+type linker interface {
+	Link(string, uint8, panda.HRPacket) error
+}
+
+func newShare(o Options) (linker, error) {
+	switch o.Link {
+	case "", "hard", "soft":
+		return newLinkStorage(o)
+	case "copy":
+		return newCopyStorage(o)
+	case "mirror":
+		return newMirrorStorage(o)
+	default:
+		return nil, fmt.Errorf("invalid link type %s", o.Link)
+	}
+}
+
 type linkstore struct {
 	link   string
 	rembad bool
@@ -17,14 +17,15 @@ import (
 )
 
 type hrdpstore struct {
-	datadir string
+	datadir *volume
+	options []roll.Option
 	encode  func(io.Writer, uint8, panda.HRPacket) error
 
 	writer io.WriteCloser
 }
 
 // instance (1) + type (1) + mode (1) + origin (1) + sequence (4) + when (4) + upi (32) + data (len(payload))
-const hrdpHeaderSize = 44
+const HRDPHeaderSize = 44
 
 func NewHRDPStorage(o Options) (Storage, error) {
 	i, err := os.Stat(o.Location)
@@ -34,11 +35,22 @@ func NewHRDPStorage(o Options) (Storage, error) {
 	if !i.IsDir() {
 		return nil, fmt.Errorf("%s: not a directory", o.Location)
 	}
-	h := hrdpstore{datadir: o.Location}
-	options := []roll.Option{
-		roll.WithThreshold(o.MaxSize, o.MaxCount),
-		roll.WithTimeout(time.Duration(o.Timeout) * time.Second),
-		roll.WithInterval(time.Duration(o.Interval) * time.Second),
+	for _, f := range o.Fallback {
+		i, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if !i.IsDir() {
+			return nil, fmt.Errorf("%s: not a directory", f)
+		}
+	}
+	h := hrdpstore{
+		datadir: newVolume(o),
+		options: []roll.Option{
+			roll.WithThreshold(o.MaxSize, o.MaxCount),
+			roll.WithTimeout(time.Duration(o.Timeout) * time.Second),
+			roll.WithInterval(time.Duration(o.Interval) * time.Second),
+		},
 	}
 
 	switch strings.ToLower(o.Format) {
@@ -49,7 +61,7 @@ func NewHRDPStorage(o Options) (Storage, error) {
 	default:
 		return nil, fmt.Errorf("unknown format %q", o.Format)
 	}
-	h.writer, err = roll.Roll(h.Open, options...)
+	h.writer, err = roll.Roll(h.Open, h.options...)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +73,14 @@ func (h *hrdpstore) Close() error {
 }
 
 func (h *hrdpstore) Store(i uint8, p panda.HRPacket) error {
+	if _, switched := h.datadir.Location(); switched {
+		h.writer.Close()
+		w, err := roll.Roll(h.Open, h.options...)
+		if err != nil {
+			return err
+		}
+		h.writer = w
+	}
 	return h.encode(h.writer, i, p)
 }
 
@@ -69,7 +89,7 @@ func (h *hrdpstore) Open(_ int, w time.Time) (io.WriteCloser, []io.Closer, error
 	doy := fmt.Sprintf("%03d", w.YearDay())
 	hour := fmt.Sprintf("%02d", w.Hour())
 
-	datadir := filepath.Join(h.datadir, year, doy, hour)
+	datadir := filepath.Join(h.datadir.Current(), year, doy, hour)
 	if err := os.MkdirAll(datadir, 0755); err != nil {
 		return nil, nil, err
 	}
@@ -86,10 +106,10 @@ func encodeHadock(ws io.Writer, i uint8, p panda.HRPacket) error {
 	upi := make([]byte, 32)
 	copy(upi, []byte(getUPI(p)))
 	var w, b bytes.Buffer
-	if err := encodeRawPacket(&b, p); err != nil {
+	if err := EncodeRawPacket(&b, p); err != nil {
 		return err
 	}
-	binary.Write(&w, binary.BigEndian, uint32(b.Len()+hrdpHeaderSize))
+	binary.Write(&w, binary.BigEndian, uint32(b.Len()+HRDPHeaderSize))
 	binary.Write(&w, binary.BigEndian, i)
 	binary.Write(&w, binary.BigEndian, p.Stream())
 	binary.Write(&w, binary.BigEndian, p.IsRealtime())
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busoc/hadock"
+	"github.com/busoc/panda"
+)
+
+// Product gives the properties of a stored packet. They are the ones used
+// to build the directory tree of an archive and can be retrieved from an
+// existing archive.
+type Product struct {
+	Instance uint8
+	Channel  panda.Channel
+	Type     string
+	Realtime bool
+	Origin   string
+	UPI      string
+	Sequence uint32
+	Format   string
+	Valid    bool
+	VMU      time.Time
+	ACQ      time.Time
+
+	// levels found in the directories or the sidecar of a stored product
+	known map[string]bool
+}
+
+func (p *Product) setKnown(n string) {
+	if p.known == nil {
+		p.known = make(map[string]bool)
+	}
+	p.known[n] = true
+}
+
+// Missing gives the levels of l that can not be set for p: the instance, the
+// type and the mode of a stored product are only known from its directories
+// and its sidecar.
+func Missing(l Layout, p Product) []string {
+	d, ok := l.(*dirmaker)
+	if !ok {
+		return nil
+	}
+	var vs []string
+	for _, n := range expandLevels(d.Levels) {
+		switch n {
+		case LevelInstance, LevelType, LevelMode:
+			if !p.known[n] {
+				vs = append(vs, n)
+			}
+		}
+	}
+	return vs
+}
+
+func expandLevels(levels []string) []string {
+	var vs []string
+	for _, n := range levels {
+		switch n = strings.ToLower(n); n {
+		case LevelClassic:
+			vs = append(vs, LevelInstance, LevelType, LevelMode, LevelSource)
+		case LevelVMUTime, LevelACQTime:
+			vs = append(vs, LevelYear, LevelDay, LevelHour, LevelMin)
+		default:
+			vs = append(vs, n)
+		}
+	}
+	return vs
+}
+
+func productOf(i uint8, p panda.HRPacket) Product {
+	return Product{
+		Instance: i,
+		Channel:  p.Stream(),
+		Type:     typeDir("", p),
+		Realtime: p.IsRealtime(),
+		Origin:   p.Origin(),
+		UPI:      getUPI(p),
+		Sequence: p.Sequence(),
+		Format:   p.Format(),
+		VMU:      getVMUTime(p),
+		ACQ:      getACQTime(p),
+	}
+}
+
+type Layout interface {
+	Directory
+	Locate(Product) string
+	Resolve(Product) (string, error)
+	Parse(string) (Product, error)
+}
+
+func NewLayout(base, time string, levels []string, interval int) Layout {
+	d := dirmaker{
+		Levels:   checkLevels(levels, []string{LevelClassic, LevelVMUTime}),
+		Base:     base,
+		Time:     time,
+		Interval: interval,
+	}
+	return &d
+}
+
+type stamp struct {
+	set                     bool
+	year, doy, hour, minute int
+}
+
+func (s stamp) Time() time.Time {
+	if !s.set {
+		return time.Time{}
+	}
+	t := time.Date(s.year, 1, 1, s.hour, s.minute, 0, 0, time.UTC)
+	return t.AddDate(0, 0, s.doy-1)
+}
+
+// Parse gives the properties of the products stored in dir by following the
+// levels of the layout in the reverse order.
+func (d *dirmaker) Parse(dir string) (Product, error) {
+	var p Product
+
+	rel, err := filepath.Rel(d.Base, dir)
+	if err != nil {
+		return p, err
+	}
+	var parts []string
+	if rel = filepath.ToSlash(rel); rel != "." {
+		parts = strings.Split(rel, "/")
+	}
+	var vmu, acq, other stamp
+	rest, err := parseDirectory(parts, d.Levels, d.Interval, &p, &other, &vmu, &acq)
+	if err != nil {
+		return p, fmt.Errorf("%s: %s", dir, err)
+	}
+	if len(rest) > 0 {
+		return p, fmt.Errorf("%s: too many levels", dir)
+	}
+	p.VMU, p.ACQ = vmu.Time(), acq.Time()
+	switch strings.ToLower(d.Time) {
+	case "vmu", "":
+		if p.VMU.IsZero() {
+			p.VMU = other.Time()
+		}
+	case "acq":
+		if p.ACQ.IsZero() {
+			p.ACQ = other.Time()
+		}
+	}
+	return p, nil
+}
+
+func parseDirectory(parts, levels []string, g int, p *Product, t, vmu, acq *stamp) ([]string, error) {
+	var err error
+	for _, n := range levels {
+		n = strings.ToLower(n)
+		switch n {
+		case LevelClassic:
+			ns := []string{LevelInstance, LevelType, LevelMode, LevelSource}
+			parts, err = parseDirectory(parts, ns, g, p, t, vmu, acq)
+		case LevelVMUTime, LevelACQTime:
+			ns := []string{LevelYear, LevelDay, LevelHour, LevelMin}
+			x := vmu
+			if n == LevelACQTime {
+				x = acq
+			}
+			parts, err = parseDirectory(parts, ns, g, p, x, vmu, acq)
+		case LevelMin:
+			if g <= 0 {
+				continue
+			}
+			fallthrough
+		default:
+			if len(parts) == 0 {
+				return nil, fmt.Errorf("missing level %s", n)
+			}
+			err = parseLevel(n, parts[0], p, t)
+			parts = parts[1:]
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func parseLevel(n, v string, p *Product, t *stamp) error {
+	var err error
+	switch n {
+	default:
+		if !strings.EqualFold(n, v) {
+			err = fmt.Errorf("unexpected %s (want %s)", v, n)
+		}
+	case LevelUPI:
+		p.UPI = v
+	case LevelInstance:
+		i, ok := ParseInstance(v)
+		if !ok {
+			err = fmt.Errorf("unknown instance %s", v)
+		}
+		p.Instance = i
+		p.setKnown(n)
+	case LevelType:
+		p.Type = v
+		p.setKnown(n)
+	case LevelMode:
+		switch v {
+		case "realtime", "playback":
+			p.Realtime = v == "realtime"
+			p.setKnown(n)
+		default:
+			err = fmt.Errorf("unknown mode %s", v)
+		}
+	case LevelSource:
+		p.Origin = v
+	case LevelYear:
+		t.year, err = strconv.Atoi(v)
+	case LevelDay:
+		t.doy, err = strconv.Atoi(v)
+	case LevelHour:
+		t.hour, err = strconv.Atoi(v)
+	case LevelMin:
+		t.minute, err = strconv.Atoi(v)
+	}
+	switch n {
+	case LevelYear, LevelDay, LevelHour, LevelMin:
+		t.set = true
+	}
+	return err
+}
+
+func ParseInstance(v string) (uint8, bool) {
+	switch v {
+	case "OPS":
+		return hadock.OPS, true
+	case "TEST":
+		return hadock.TEST, true
+	case "SIM1":
+		return hadock.SIM1, true
+	case "SIM2":
+		return hadock.SIM2, true
+	}
+	if !strings.HasPrefix(v, "DATA-") {
+		return 0, false
+	}
+	i, err := strconv.ParseUint(strings.TrimPrefix(v, "DATA-"), 10, 8)
+	return uint8(i), err == nil
+}
+
+// ParseFilename gives the origin, sequence, acquisition time and format of a
+// product from its name: <origin>_<sequence>_<YYYYmmdd>_<HHMMSS>.<format>.
+func ParseFilename(n string) (Product, error) {
+	var p Product
+
+	n = filepath.Base(n)
+	p.Valid = filepath.Ext(n) != BAD
+	fs := strings.FieldsFunc(strings.TrimSuffix(n, BAD), func(r rune) bool {
+		return r == '_' || r == '.'
+	})
+	if len(fs) < 5 {
+		return p, fmt.Errorf("%s: unexpected filename", n)
+	}
+	seq, err := strconv.ParseUint(fs[1], 10, 32)
+	if err != nil {
+		return p, fmt.Errorf("%s: invalid sequence %s", n, fs[1])
+	}
+	acq, err := time.Parse("20060102_150405", fs[2]+"_"+fs[3])
+	if err != nil {
+		return p, fmt.Errorf("%s: invalid time %s_%s", n, fs[2], fs[3])
+	}
+	p.Origin, p.Sequence, p.ACQ, p.Format = fs[0], uint32(seq), acq, fs[4]
+	return p, nil
+}
+
+func ReadMetadata(file string) (Metadata, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer r.Close()
+	return DecodeMetadata(r, file)
+}
+
+func DecodeMetadata(r io.Reader, file string) (Metadata, error) {
+	var (
+		m   Metadata
+		err error
+	)
+	switch filepath.Ext(file) {
+	case JSON:
+		err = json.NewDecoder(r).Decode(&m)
+	default:
+		err = xml.NewDecoder(r).Decode(&m)
+	}
+	return m, err
+}
+
+// Describe gives the properties of the product stored in file by merging the
+// ones found in its directory (according to the layout), its name and its
+// sidecar if any.
+func Describe(l Layout, file string) (Product, error) {
+	p, err := DescribeName(l, file)
+	if err != nil {
+		return p, err
+	}
+	for _, ext := range []string{XML, JSON} {
+		m, err := ReadMetadata(file + ext)
+		if err != nil {
+			continue
+		}
+		return p.WithMetadata(m), nil
+	}
+	return p, nil
+}
+
+// DescribeName is like Describe but only looks at the name of file.
+func DescribeName(l Layout, file string) (Product, error) {
+	p, err := l.Parse(filepath.Dir(file))
+	if err != nil {
+		return p, err
+	}
+	f, err := ParseFilename(file)
+	if err != nil {
+		return p, err
+	}
+	if p.Origin == "" {
+		p.Origin = f.Origin
+	}
+	p.Sequence, p.Format, p.ACQ, p.Valid = f.Sequence, f.Format, f.ACQ, f.Valid
+	return p, nil
+}
+
+func (p Product) WithMetadata(m Metadata) Product {
+	if !m.When.IsZero() {
+		p.VMU = panda.AdjustGenerationTime(m.When.Unix())
+	}
+	if m.UPI != "" {
+		p.UPI = m.UPI
+	}
+	// sidecars written by older versions only have the vmu time
+	if i, ok := ParseInstance(m.Instance); ok {
+		p.Instance = i
+		p.Valid = p.Valid && m.Valid
+		p.setKnown(LevelInstance)
+	}
+	return p
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/midbel/xxh"
+)
+
+const (
+	SumXXH64  = "xxh64"
+	SumSHA256 = "sha256"
+)
+
+const MANIFEST = "MANIFEST"
+
+// manifests are shared by the storages and their shares
+var manifests sync.Mutex
+
+// manifest keeps the checksums of the files written by a storage. Each line
+// has the same format as the one of sha256sum: the checksum followed by two
+// spaces and the name of the file.
+type manifest struct {
+	Ext string
+	sum func([]byte) string
+}
+
+func newManifest(alg string) (*manifest, error) {
+	if alg == "" {
+		return nil, nil
+	}
+	sum, err := checksumFunc(alg)
+	if err != nil {
+		return nil, err
+	}
+	m := manifest{
+		Ext: "." + strings.ToLower(alg),
+		sum: sum,
+	}
+	return &m, nil
+}
+
+func (m *manifest) Append(file, name string, bs []byte) error {
+	if m == nil {
+		return nil
+	}
+	return AppendManifest(file, name, m.sum(bs))
+}
+
+// Remove drops the lines of the files given by names from the manifest file.
+func (m *manifest) Remove(file string, names ...string) error {
+	if m == nil {
+		return nil
+	}
+	manifests.Lock()
+	defer manifests.Unlock()
+	return dropManifest(file, names)
+}
+
+// AppendManifest adds the checksum sum of the file name to the manifest file.
+func AppendManifest(file, name, sum string) error {
+	manifests.Lock()
+	defer manifests.Unlock()
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s  %s\n", sum, name); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// DropManifest drops the lines of the files given by names from the
+// manifests found in dir.
+func DropManifest(dir string, names ...string) error {
+	ms, err := filepath.Glob(filepath.Join(dir, MANIFEST+".*"))
+	if err != nil {
+		return err
+	}
+	manifests.Lock()
+	defer manifests.Unlock()
+	for _, m := range ms {
+		if err := dropManifest(m, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropManifest(file string, names []string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	var (
+		w    bytes.Buffer
+		drop bool
+	)
+	s := bufio.NewScanner(bytes.NewReader(bs))
+	for s.Scan() {
+		fs := strings.SplitN(s.Text(), "  ", 2)
+		if len(fs) == 2 && contains(names, fs[1]) {
+			drop = true
+			continue
+		}
+		w.WriteString(s.Text() + "\n")
+	}
+	if err := s.Err(); err != nil || !drop {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, w.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func contains(vs []string, v string) bool {
+	for _, x := range vs {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func Checksum(alg string, bs []byte) (string, error) {
+	sum, err := checksumFunc(alg)
+	if err != nil {
+		return "", err
+	}
+	return sum(bs), nil
+}
+
+// ReadManifest gives the checksums found in file by name. When a name
+// appears more than once, the last checksum is kept since the file has been
+// overwritten.
+func ReadManifest(file string) (map[string]string, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	sums := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fs := strings.SplitN(s.Text(), "  ", 2)
+		if len(fs) != 2 {
+			continue
+		}
+		sums[fs[1]] = fs[0]
+	}
+	return sums, s.Err()
+}
+
+func checksumFunc(alg string) (func([]byte) string, error) {
+	var sum func([]byte) string
+	switch strings.ToLower(alg) {
+	case SumXXH64:
+		sum = func(bs []byte) string {
+			return fmt.Sprintf("%016x", xxh.Sum64(bs, 0))
+		}
+	case SumSHA256:
+		sum = func(bs []byte) string {
+			return fmt.Sprintf("%x", sha256.Sum256(bs))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %s", strconv.Quote(alg))
+	}
+	return sum, nil
+}
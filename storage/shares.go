@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/busoc/panda"
+)
+
+const (
+	DefaultRetry  = 30
+	backlogFile   = ".backlog"
+	mirrorTimeout = time.Second * 10
+	mirrorQueue   = 64
+)
+
+type copystore struct {
+	rembad  bool
+	data    Directory
+	sums    *manifest
+	backlog *backlog
+}
+
+func newCopyStorage(o Options) (*copystore, error) {
+	i, err := os.Stat(o.Location)
+	if err != nil {
+		return nil, err
+	}
+	if !i.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", o.Location)
+	}
+	sums, err := newManifest(o.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	levels := checkLevels(o.Levels, []string{LevelClassic, LevelACQTime})
+	c := copystore{
+		rembad: !o.KeepBad,
+		data:   NewDirectory(o.Location, o.Epoch, levels, o.Interval),
+		sums:   sums,
+	}
+	file := o.Backlog
+	if file == "" {
+		file = filepath.Join(o.Location, backlogFile)
+	}
+	if c.backlog, err = newBacklog(file, o.Retry, c.copy); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *copystore) Link(link string, i uint8, p panda.HRPacket) error {
+	dir, err := c.data.Prepare(i, p)
+	if err != nil {
+		return err
+	}
+	filename := path.Base(link)
+	if !p.IsRealtime() && c.rembad {
+		if os.Remove(path.Join(dir, filename+BAD)) == nil && c.sums != nil {
+			c.sums.Remove(path.Join(dir, MANIFEST+c.sums.Ext), filename+BAD)
+		}
+	}
+	file := path.Join(dir, filename)
+	if err := c.copy(link, file); err != nil {
+		return c.backlog.Push(link, file)
+	}
+	return nil
+}
+
+func (c *copystore) Close() error {
+	return c.backlog.Close()
+}
+
+// copy copies src to dst and records the checksum of dst in the manifest of
+// the share.
+func (c *copystore) copy(src, dst string) error {
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	if c.sums == nil {
+		return nil
+	}
+	bs, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return err
+	}
+	return c.sums.Append(filepath.Join(filepath.Dir(dst), MANIFEST+c.sums.Ext), filepath.Base(dst), bs)
+}
+
+// mirrorstore pushes the products to the mirror in its own goroutine so that
+// an unreachable mirror does not hold back the storage. Transfers go to the
+// backlog while it is not empty or after a failed push.
+type mirrorstore struct {
+	url     string
+	secret  string
+	data    *dirmaker
+	client  *http.Client
+	backlog *backlog
+	queue   chan transfer
+	done    chan struct{}
+	failed  int32
+	closed  int32
+}
+
+type transfer struct {
+	src string
+	dst string
+}
+
+func newMirrorStorage(o Options) (*mirrorstore, error) {
+	if !strings.HasPrefix(o.Location, "http://") && !strings.HasPrefix(o.Location, "https://") {
+		return nil, fmt.Errorf("%s: not a http(s) url", o.Location)
+	}
+	if o.Backlog == "" {
+		return nil, fmt.Errorf("%s: backlog file required", o.Location)
+	}
+	if o.Secret == "" {
+		return nil, fmt.Errorf("%s: secret required", o.Location)
+	}
+	m := mirrorstore{
+		url:    strings.TrimSuffix(o.Location, "/"),
+		secret: o.Secret,
+		queue:  make(chan transfer, mirrorQueue),
+		done:   make(chan struct{}),
+		data: &dirmaker{
+			Levels:   checkLevels(o.Levels, []string{LevelClassic, LevelACQTime}),
+			Time:     o.Epoch,
+			Interval: o.Interval,
+		},
+		client: &http.Client{Timeout: mirrorTimeout},
+	}
+	var err error
+	if m.backlog, err = newBacklog(o.Backlog, o.Retry, m.push); err != nil {
+		return nil, err
+	}
+	go m.run()
+	return &m, nil
+}
+
+func (m *mirrorstore) Link(link string, i uint8, p panda.HRPacket) error {
+	file := path.Join(m.data.Path(i, p), path.Base(link))
+	if atomic.LoadInt32(&m.failed) == 1 || !m.backlog.Empty() {
+		return m.backlog.Push(link, file)
+	}
+	select {
+	case m.queue <- transfer{src: link, dst: file}:
+		return nil
+	default:
+		return m.backlog.Push(link, file)
+	}
+}
+
+// Close stops the retries of the backlog and moves the transfers still queued
+// to it.
+func (m *mirrorstore) Close() error {
+	err := m.backlog.Close()
+	atomic.StoreInt32(&m.closed, 1)
+	close(m.queue)
+	<-m.done
+	return err
+}
+
+func (m *mirrorstore) run() {
+	defer close(m.done)
+	for t := range m.queue {
+		if atomic.LoadInt32(&m.closed) == 1 {
+			m.backlog.Push(t.src, t.dst)
+			continue
+		}
+		if err := m.push(t.src, t.dst); err != nil {
+			m.backlog.Push(t.src, t.dst)
+		}
+	}
+}
+
+// push sends src to the mirror with its SHA256 in the digest header so that
+// the mirror can check and record it in its manifests.
+func (m *mirrorstore) push(src, dst string) error {
+	bs, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, m.url+"/"+strings.TrimPrefix(dst, "/"), bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(bs)
+	req.Header.Set("authorization", "Bearer "+m.secret)
+	req.Header.Set("digest", "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	res, err := m.client.Do(req)
+	if err == nil {
+		defer res.Body.Close()
+		io.Copy(ioutil.Discard, res.Body)
+		if res.StatusCode >= http.StatusBadRequest {
+			err = fmt.Errorf("%s: unexpected status %s", dst, res.Status)
+		}
+	}
+	if err != nil {
+		atomic.StoreInt32(&m.failed, 1)
+	} else {
+		atomic.StoreInt32(&m.failed, 0)
+	}
+	return err
+}
+
+// backlog keeps in a file the list of products that could not be transferred
+// to a share. Each line of the file is made of the source and the target of
+// a transfer separated by a tab. Transfers are retried at regular interval.
+type backlog struct {
+	file     string
+	transfer func(string, string) error
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBacklog(file string, every int, transfer func(string, string) error) (*backlog, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	if every <= 0 {
+		every = DefaultRetry
+	}
+	b := backlog{
+		file:     file,
+		transfer: transfer,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run(time.Second * time.Duration(every))
+	return &b, nil
+}
+
+func (b *backlog) Push(src, dst string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, err := os.OpenFile(b.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s\t%s\n", src, dst); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Empty tells if no transfer is waiting in the backlog.
+func (b *backlog) Empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, err := os.Stat(b.file)
+	return err != nil || i.Size() == 0
+}
+
+// Close stops the retries and waits for the one in progress to complete.
+func (b *backlog) Close() error {
+	close(b.stop)
+	<-b.done
+	return nil
+}
+
+func (b *backlog) run(every time.Duration) {
+	defer close(b.done)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.retry()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *backlog) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *backlog) retry() {
+	b.mu.Lock()
+	bs, err := ioutil.ReadFile(b.file)
+	b.mu.Unlock()
+	if err != nil || len(bs) == 0 {
+		return
+	}
+	var (
+		rest bytes.Buffer
+		fail bool
+	)
+	for _, line := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		fs := strings.Split(line, "\t")
+		if len(fs) != 2 {
+			continue
+		}
+		if _, err := os.Stat(fs[0]); err != nil {
+			continue
+		}
+		if !fail && b.stopped() {
+			fail = true
+		}
+		if !fail {
+			if err := b.transfer(fs[0], fs[1]); err == nil {
+				continue
+			}
+			// the share is most likely unreachable: keep the remaining
+			// transfers for the next attempt
+			fail = true
+		}
+		rest.WriteString(line + "\n")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if vs, err := ioutil.ReadFile(b.file); err == nil && len(vs) > len(bs) {
+		rest.Write(vs[len(bs):])
+	}
+	tmp := b.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, rest.Bytes(), 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, b.file)
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	w, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	os.Chmod(w.Name(), 0644)
+	return os.Rename(w.Name(), dst)
+}
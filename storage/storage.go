@@ -3,6 +3,8 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -13,6 +15,8 @@ import (
 	"time"
 
 	"github.com/busoc/hadock"
+	"github.com/busoc/hadock/catalog"
+	img "github.com/busoc/hadock/internal/image"
 	"github.com/busoc/panda"
 )
 
@@ -72,7 +76,34 @@ type Options struct {
 	Levels []string   `toml:"levels"`
 	Shares []*Options `toml:"share"`
 
-	Link string `toml:"link"`
+	Link     string `toml:"link"`
+	Meta     string `toml:"metadata"`
+	Manifest string `toml:"manifest"`
+	// compute the statistics of the pixels of images in their metadata
+	Statistics bool `toml:"statistics"`
+
+	// share options: file where failed copies are kept and interval (in
+	// seconds) between two attempts to process it
+	Backlog string `toml:"backlog"`
+	Retry   int    `toml:"retry"`
+	// secret given to distrib by mirror shares
+	Secret string `toml:"secret"`
+
+	// watchdog options: threshold is the low watermark (in MB) of free space
+	// below which data are written to the next fallback location and margin
+	// the free space (in MB) above the threshold needed to switch back to a
+	// preferred location (default to the threshold)
+	Threshold int      `toml:"threshold"`
+	Margin    int      `toml:"margin"`
+	Fallback  []string `toml:"fallback"`
+
+	Alert  func(hadock.Message) `toml:"-"`
+	Record func(catalog.Entry)  `toml:"-"`
+
+	// worker options: size of the queue and time (in milliseconds) to wait for
+	// a slot in the queue before dropping a packet
+	QueueSize    int `toml:"queue-size"`
+	QueueTimeout int `toml:"queue-timeout"`
 }
 
 const (
@@ -135,6 +166,8 @@ type dirmaker struct {
 	Base     string   `toml:"location"`
 	Time     string   `toml:"time"`
 	Interval int      `toml:"-"`
+
+	volume *volume
 }
 
 type Directory interface {
@@ -142,32 +175,42 @@ type Directory interface {
 }
 
 func NewDirectory(base, time string, levels []string, interval int) Directory {
-	d := dirmaker{
-		Levels:   checkLevels(levels, []string{LevelClassic, LevelVMUTime}),
-		Base:     base,
-		Time:     time,
-		Interval: interval,
-	}
-	return &d
+	return NewLayout(base, time, levels, interval)
 }
 
 func (d *dirmaker) Prepare(i uint8, p panda.HRPacket) (string, error) {
+	return d.Resolve(productOf(i, p))
+}
+
+func (d *dirmaker) Resolve(p Product) (string, error) {
+	base := d.Locate(p)
+	if err := os.MkdirAll(base, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return base, nil
+}
+
+func (d *dirmaker) Path(i uint8, p panda.HRPacket) string {
+	return d.Locate(productOf(i, p))
+}
+
+func (d *dirmaker) Locate(p Product) string {
 	var t time.Time
 	switch strings.ToLower(d.Time) {
 	case "vmu", "":
-		t = getVMUTime(p)
+		t = p.VMU
 	case "acq":
-		t = getACQTime(p)
+		t = p.ACQ
 	default:
 	}
 	if t.IsZero() {
-		t = p.Timestamp()
+		t = p.ACQ
 	}
-	base := prepareDirectory(d.Base, d.Levels, d.Interval, i, p, t)
-	if err := os.MkdirAll(base, 0755); err != nil && !os.IsExist(err) {
-		return "", err
+	base := d.Base
+	if d.volume != nil {
+		base, _ = d.volume.Location()
 	}
-	return base, nil
+	return prepareDirectory(base, d.Levels, d.Interval, p, t)
 }
 
 func checkLevels(ls, ds []string) []string {
@@ -184,24 +227,24 @@ func checkLevels(ls, ds []string) []string {
 	return vs
 }
 
-func prepareDirectory(base string, levels []string, g int, i uint8, p panda.HRPacket, t time.Time) string {
+func prepareDirectory(base string, levels []string, g int, p Product, t time.Time) string {
 	for _, n := range levels {
 		switch strings.ToLower(n) {
 		default:
 			base = path.Join(base, n)
 		case LevelClassic:
 			ns := []string{LevelInstance, LevelType, LevelMode, LevelSource}
-			base = prepareDirectory(base, ns, g, i, p, t)
+			base = prepareDirectory(base, ns, g, p, t)
 		case LevelUPI:
-			base = path.Join(base, getUPI(p))
+			base = path.Join(base, p.UPI)
 		case LevelInstance:
-			base = instanceDir(base, i)
+			base = instanceDir(base, p.Instance)
 		case LevelType:
-			base = typeDir(base, p)
+			base = path.Join(base, p.Type)
 		case LevelMode:
-			base = modeDir(base, p)
+			base = path.Join(base, modeName(p.Realtime))
 		case LevelSource:
-			base = path.Join(base, p.Origin())
+			base = path.Join(base, p.Origin)
 		case LevelYear:
 			base = path.Join(base, fmt.Sprintf("%04d", t.Year()))
 		case LevelDay:
@@ -214,10 +257,10 @@ func prepareDirectory(base string, levels []string, g int, i uint8, p panda.HRPa
 			}
 		case LevelVMUTime:
 			ns := []string{LevelYear, LevelDay, LevelHour, LevelMin}
-			base = prepareDirectory(base, ns, g, i, p, getVMUTime(p))
+			base = prepareDirectory(base, ns, g, p, p.VMU)
 		case LevelACQTime:
 			ns := []string{LevelYear, LevelDay, LevelHour, LevelMin}
-			base = prepareDirectory(base, ns, g, i, p, getACQTime(p))
+			base = prepareDirectory(base, ns, g, p, p.ACQ)
 		}
 	}
 	return base
@@ -270,12 +313,14 @@ func getUPI(p panda.HRPacket) string {
 }
 
 func modeDir(base string, p panda.HRPacket) string {
-	if p.IsRealtime() {
-		base = path.Join(base, "realtime")
-	} else {
-		base = path.Join(base, "playback")
+	return path.Join(base, modeName(p.IsRealtime()))
+}
+
+func modeName(realtime bool) string {
+	if realtime {
+		return "realtime"
 	}
-	return base
+	return "playback"
 }
 
 func typeDir(base string, p panda.HRPacket) string {
@@ -304,23 +349,116 @@ func instanceDir(base string, i uint8) string {
 	return base
 }
 
-func encodeMetadata(w io.Writer, p *panda.Image) error {
-	m := struct {
-		XMLName xml.Name  `xml:"metadata"`
-		Version int       `xml:"mark,attr"`
-		When    time.Time `xml:"vmu,attr"`
-		IDH     interface{}
-	}{
-		Version: p.Version(),
-		When:    p.VMUHeader.Timestamp(),
-		IDH:     p.IDH,
+type Metadata struct {
+	XMLName  xml.Name    `xml:"metadata" json:"-"`
+	Version  int         `xml:"mark,attr" json:"mark"`
+	When     time.Time   `xml:"vmu,attr" json:"vmu"`
+	Instance string      `xml:"instance,attr" json:"instance"`
+	Valid    bool        `xml:"valid,attr" json:"valid"`
+	Ingested time.Time   `xml:"ingested,attr" json:"ingested"`
+	UPI      string      `xml:"upi,attr,omitempty" json:"upi,omitempty"`
+	IDH      interface{} `xml:",omitempty" json:"idh,omitempty"`
+	SDH      interface{} `xml:",omitempty" json:"sdh,omitempty"`
+	Stats    *img.Stats  `xml:"stats,omitempty" json:"stats,omitempty"`
+
+	// Info is the info of the secondary header in hexadecimal since its bytes
+	// can not all be written in XML.
+	Info string `xml:"info,attr,omitempty" json:"-"`
+	// Recovered is set when the sidecar is rebuilt from the content of its
+	// product: fields that can not be recovered are left empty.
+	Recovered bool `xml:"recovered,attr,omitempty" json:"recovered,omitempty"`
+}
+
+// RecoveredMetadata gives the metadata of the stored product p whose sidecar
+// is lost with h as its secondary header (IDH or SDH).
+func RecoveredMetadata(p Product, h interface{}) Metadata {
+	m := Metadata{
+		Valid:     p.Valid,
+		Ingested:  time.Now().UTC(),
+		UPI:       p.UPI,
+		Recovered: true,
+	}
+	if p.known[LevelInstance] {
+		m.Instance = instanceDir("", p.Instance)
+	}
+	switch h := h.(type) {
+	case *panda.IDHv2:
+		m.IDH = h
+	case *panda.SDHv2:
+		m.SDH = h
+	}
+	return m
+}
+
+func metadataFormat(f string) (string, error) {
+	switch strings.ToLower(f) {
+	case "", "xml":
+		return XML, nil
+	case "json":
+		return JSON, nil
+	default:
+		return "", fmt.Errorf("unknown metadata format %q", f)
+	}
+}
+
+func encodeMetadata(w io.Writer, i uint8, p panda.HRPacket, format string, stats bool) error {
+	m := Metadata{
+		Version:  p.Version(),
+		Instance: instanceDir("", i),
+		Valid:    panda.Valid(p),
+		Ingested: time.Now().UTC(),
+		UPI:      getUPI(p),
+	}
+	switch p := p.(type) {
+	case *panda.Image:
+		m.When, m.IDH = p.VMUHeader.Timestamp(), p.IDH
+		if stats {
+			m.Stats = statsOf(p)
+		}
+	case *panda.Table:
+		m.When, m.SDH = p.VMUHeader.Timestamp(), p.SDH
+	default:
+		return nil
+	}
+	return EncodeMetadata(w, m, format)
+}
+
+// EncodeMetadata writes m to w as XML or JSON according to format.
+func EncodeMetadata(w io.Writer, m Metadata, format string) error {
+	switch format {
+	case JSON:
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		return e.Encode(m)
+	default:
+		if h, ok := m.IDH.(*panda.IDHv2); ok {
+			m.Info = hex.EncodeToString(h.Info[:])
+		}
+		if h, ok := m.SDH.(*panda.SDHv2); ok {
+			m.Info = hex.EncodeToString(h.Info[:])
+		}
+		e := xml.NewEncoder(w)
+		e.Indent("", "\t")
+		return e.Encode(m)
+	}
+}
+
+// statsOf gives the statistics of the pixels of an image or nil when its
+// pixels can not be decoded.
+func statsOf(p *panda.Image) *img.Stats {
+	b, ok := p.IDH.(panda.Bitmap)
+	if !ok {
+		return nil
+	}
+	g, err := img.Decode(b.FCC(), int(b.X()), int(b.Y()), p.Payload())
+	if err != nil {
+		return nil
 	}
-	e := xml.NewEncoder(w)
-	e.Indent("", "\t")
-	return e.Encode(m)
+	s := img.Statistics(g)
+	return &s
 }
 
-func encodeRawPacket(w io.Writer, p panda.HRPacket) error {
+func EncodeRawPacket(w io.Writer, p panda.HRPacket) error {
 	var err error
 	switch p := p.(type) {
 	case *panda.Table:
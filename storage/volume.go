@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/busoc/hadock"
+)
+
+const (
+	UPIFailover = "FAILOVER"
+	UPIRestored = "RESTORED"
+)
+
+// volume selects the location where a storage should write its data. The
+// first location is preferred and the fallback locations are used in order
+// when the free space of the current one goes below the low watermark. A
+// preferred location is only used again once its free space goes above the
+// high watermark.
+type volume struct {
+	threshold uint64
+	high      uint64
+	locations []string
+	alert     func(hadock.Message)
+
+	mu      sync.Mutex
+	when    time.Time
+	current int
+}
+
+func newVolume(o Options) *volume {
+	v := volume{
+		threshold: uint64(o.Threshold) << 20,
+		locations: append([]string{o.Location}, o.Fallback...),
+		alert:     o.Alert,
+	}
+	if o.Margin > 0 {
+		v.high = v.threshold + uint64(o.Margin)<<20
+	} else {
+		v.high = v.threshold * 2
+	}
+	return &v
+}
+
+func (v *volume) Current() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.locations[v.current]
+}
+
+// Location gives the location to use and reports whether a switch to another
+// location happened since the previous call.
+func (v *volume) Location() (string, bool) {
+	if v.threshold == 0 || len(v.locations) <= 1 {
+		return v.locations[0], false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.when) < time.Second {
+		return v.locations[v.current], false
+	}
+	v.when = time.Now()
+
+	next := v.next()
+	if next == v.current {
+		return v.locations[v.current], false
+	}
+	prev := v.locations[v.current]
+	v.current = next
+	v.notify(prev, v.locations[next])
+
+	return v.locations[next], true
+}
+
+func (v *volume) next() int {
+	for i := 0; i < v.current; i++ {
+		if z, err := freeSpace(v.locations[i]); err == nil && z >= v.high {
+			return i
+		}
+	}
+	if z, err := freeSpace(v.locations[v.current]); err == nil && z >= v.threshold {
+		return v.current
+	}
+	for i, d := range v.locations {
+		if z, err := freeSpace(d); i != v.current && err == nil && z >= v.threshold {
+			return i
+		}
+	}
+	return v.current
+}
+
+func (v *volume) notify(from, to string) {
+	if v.alert == nil {
+		return
+	}
+	upi := UPIFailover
+	if to == v.locations[0] {
+		upi = UPIRestored
+	}
+	now := time.Now().Unix()
+	m := hadock.Message{
+		Origin:    "storage",
+		Instance:  -1,
+		Generated: now,
+		Acquired:  now,
+		Reference: from + " -> " + to,
+		UPI:       upi,
+	}
+	v.alert(m)
+}
+
+func freeSpace(d string) (uint64, error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(d, &s); err != nil {
+		return 0, err
+	}
+	return s.Bavail * uint64(s.Bsize), nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/busoc/panda"
+)
+
+const DefaultQueueSize = 1000
+
+// Stats gives the number of packets handled by the worker of a storage since
+// it was started.
+type Stats struct {
+	Name     string `json:"name"`
+	Stored   uint64 `json:"stored"`
+	Errors   uint64 `json:"errors"`
+	Dropped  uint64 `json:"dropped"`
+	Queued   int    `json:"queued"`
+	Capacity int    `json:"capacity"`
+}
+
+// Statistics gives the stats of the workers of s.
+func Statistics(s Storage) []Stats {
+	switch s := s.(type) {
+	case *multistore:
+		var vs []Stats
+		for _, s := range s.ms {
+			vs = append(vs, Statistics(s)...)
+		}
+		return vs
+	case *worker:
+		return []Stats{s.Stats()}
+	default:
+		return nil
+	}
+}
+
+type item struct {
+	instance uint8
+	panda.HRPacket
+}
+
+// worker runs a storage in its own goroutine. Packets are given to the
+// storage through a bounded queue so that a slow storage does not hold back
+// the others.
+type worker struct {
+	Storage
+
+	name    string
+	timeout time.Duration
+	queue   chan item
+	done    chan struct{}
+
+	stored  uint64
+	errors  uint64
+	dropped uint64
+}
+
+func Async(s Storage, o Options) Storage {
+	size := o.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	w := worker{
+		Storage: s,
+		name:    fmt.Sprintf("%s(%s)", o.Scheme, o.Location),
+		timeout: time.Duration(o.QueueTimeout) * time.Millisecond,
+		queue:   make(chan item, size),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return &w
+}
+
+func (w *worker) Store(i uint8, p panda.HRPacket) error {
+	x := item{instance: i, HRPacket: p}
+	if w.timeout <= 0 {
+		select {
+		case w.queue <- x:
+			return nil
+		default:
+		}
+	} else {
+		t := time.NewTimer(w.timeout)
+		defer t.Stop()
+		select {
+		case w.queue <- x:
+			return nil
+		case <-t.C:
+		}
+	}
+	atomic.AddUint64(&w.dropped, 1)
+	return fmt.Errorf("%s: queue full", w.name)
+}
+
+func (w *worker) Stats() Stats {
+	return Stats{
+		Name:     w.name,
+		Stored:   atomic.LoadUint64(&w.stored),
+		Errors:   atomic.LoadUint64(&w.errors),
+		Dropped:  atomic.LoadUint64(&w.dropped),
+		Queued:   len(w.queue),
+		Capacity: cap(w.queue),
+	}
+}
+
+// Close stores the packets still queued before closing the storage.
+func (w *worker) Close() error {
+	close(w.queue)
+	<-w.done
+	if c, ok := w.Storage.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+
+	logger := log.New(os.Stderr, "[storage] ", 0)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	var last Stats
+	for {
+		select {
+		case i, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			if err := w.Storage.Store(i.instance, i.HRPacket); err != nil {
+				atomic.AddUint64(&w.errors, 1)
+				logger.Printf("%s: storing VMU packet %s failed: %s", w.name, i.Filename(), err)
+			} else {
+				atomic.AddUint64(&w.stored, 1)
+			}
+		case <-tick.C:
+			s := w.Stats()
+			var (
+				errors  = s.Errors - last.Errors
+				dropped = s.Dropped - last.Dropped
+			)
+			if errors > 0 || dropped > 0 {
+				logger.Printf("%s: %6d stored, %6d errors, %6d dropped, %6d queued", w.name, s.Stored-last.Stored, errors, dropped, s.Queued)
+			}
+			last = s
+		}
+	}
+}
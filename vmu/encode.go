@@ -11,52 +11,100 @@ import (
 	"github.com/busoc/timutil"
 )
 
-func EncodePacket(ws io.Writer, p panda.HRPacket, hrdp bool) error {
-	var (
-		err    error
-		buffer bytes.Buffer
-	)
-	if hrdp {
-		if err := encodeHRDPHeader(&buffer, p); err != nil {
-			return err
-		}
+// Packet gives the parts of a VMU packet. Header is the secondary header of
+// the packet (*panda.SDHv2 or *panda.IDHv2). Generated is the acquisition time
+// given in the HRDP header (the current time when zero).
+type Packet struct {
+	*panda.VMUHeader
+	Header    interface{}
+	Payload   []byte
+	Generated time.Time
+}
+
+// NewHeader gives the VMU header of a packet of channel c. The source of
+// realtime packets is their channel. The fine time is given in 1/65536
+// second.
+func NewHeader(c panda.Channel, realtime bool, seq uint32, t time.Time) *panda.VMUHeader {
+	v := panda.VMUHeader{
+		Channel:  c,
+		Sequence: seq,
+		Coarse:   uint32(t.Unix()),
+		Fine:     uint16((int64(t.Nanosecond()) << 16) / int64(time.Second)),
+	}
+	if realtime {
+		v.Source = uint8(c)
 	}
+	return &v
+}
+
+func EncodePacket(ws io.Writer, p panda.HRPacket, hrdp bool) error {
+	var k Packet
 	switch p := p.(type) {
 	case *panda.Table:
-		err = encodeTable(&buffer, p)
+		k = Packet{VMUHeader: p.VMUHeader, Header: p.SDH}
 	case *panda.Image:
-		err = encodeImage(&buffer, p)
+		k = Packet{VMUHeader: p.VMUHeader, Header: p.IDH}
 	default:
-		err = fmt.Errorf("unsupported packet type %T", p)
+		return fmt.Errorf("unsupported packet type %T", p)
 	}
-	if err != nil {
+	k.Payload = p.Payload()
+	if g, ok := p.(interface{ Generated() time.Time }); ok {
+		k.Generated = g.Generated()
+	}
+	return Encode(ws, k, hrdp)
+}
+
+// Encode writes p with its HRDL framing preceded by a HRDP header when hrdp
+// is set. Sizes are given by the encoded secondary header.
+func Encode(ws io.Writer, p Packet, hrdp bool) error {
+	var h bytes.Buffer
+	switch s := p.Header.(type) {
+	case *panda.SDHv2:
+		encodeSDH(&h, s)
+	case *panda.IDHv2:
+		encodeIDH(&h, s)
+	default:
+		return fmt.Errorf("unsupported header %T", p.Header)
+	}
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, uint32(HRDLMagic))
+	binary.Write(&body, binary.LittleEndian, uint32(VMUHLen+h.Len()+len(p.Payload)-4))
+
+	digest := SumHRDL()
+	w := io.MultiWriter(&body, digest)
+	if err := encodeVMUHeader(w, p.VMUHeader); err != nil {
 		return err
 	}
-	_, err = io.Copy(ws, &buffer)
+	w.Write(h.Bytes())
+	w.Write(p.Payload)
+	binary.Write(&body, binary.LittleEndian, digest.Sum32())
+
+	var buffer bytes.Buffer
+	if hrdp {
+		if err := encodeHRDPHeader(&buffer, p, body.Len()); err != nil {
+			return err
+		}
+	}
+	body.WriteTo(&buffer)
+	_, err := io.Copy(ws, &buffer)
 	return err
 }
 
-func encodeHRDPHeader(ws io.Writer, p panda.HRPacket) error {
-	size := uint32(HRDPHeaderLen + HRDLSyncLen + VMUHLen + 4)
-	switch c := p.Stream(); c {
-	case panda.Science:
-		size += SDHLenV2
-	case panda.Video1, panda.Video2:
-		size += IDHLenV2
+func encodeHRDPHeader(ws io.Writer, p Packet, n int) error {
+	switch c := p.Channel; c {
+	case panda.Science, panda.Video1, panda.Video2:
 	default:
 		return fmt.Errorf("unknown channel %d", c)
 	}
-	size += uint32(len(p.Payload()))
-
-	binary.Write(ws, binary.LittleEndian, size)
+	binary.Write(ws, binary.LittleEndian, uint32(HRDPHeaderLen+n))
 	binary.Write(ws, binary.BigEndian, uint16(0))
 	binary.Write(ws, binary.BigEndian, uint8(FSLMagic))
-	binary.Write(ws, binary.BigEndian, p.Stream())
+	binary.Write(ws, binary.BigEndian, p.Channel)
 
 	acq := time.Now()
 	now := timutil.GPSTime(acq, true)
-	if g, ok := p.(interface{ Generated() time.Time }); ok {
-		acq = g.Generated()
+	if !p.Generated.IsZero() {
+		acq = p.Generated
 	}
 	var (
 		fine   uint32
@@ -73,6 +121,9 @@ func encodeHRDPHeader(ws io.Writer, p panda.HRPacket) error {
 }
 
 func encodeVMUHeader(ws io.Writer, v *panda.VMUHeader) error {
+	if v == nil {
+		return fmt.Errorf("missing VMU header")
+	}
 	binary.Write(ws, binary.LittleEndian, v.Channel)
 	binary.Write(ws, binary.LittleEndian, v.Source)
 	binary.Write(ws, binary.LittleEndian, uint16(0))
@@ -83,22 +134,7 @@ func encodeVMUHeader(ws io.Writer, v *panda.VMUHeader) error {
 	return nil
 }
 
-func encodeTable(ws io.Writer, p *panda.Table) error {
-	body := p.Payload()
-	size := uint32(VMUHLen + SDHLenV2 + len(body) - 4)
-
-	binary.Write(ws, binary.BigEndian, uint32(HRDLMagic))
-	binary.Write(ws, binary.LittleEndian, size)
-
-	digest := SumHRDL()
-	ws = io.MultiWriter(ws, digest)
-	if err := encodeVMUHeader(ws, p.VMUHeader); err != nil {
-		return err
-	}
-	s, ok := p.SDH.(*panda.SDHv2)
-	if !ok {
-		return fmt.Errorf("invalid SDH version")
-	}
+func encodeSDH(ws io.Writer, s *panda.SDHv2) {
 	binary.Write(ws, binary.LittleEndian, s.Properties)
 	binary.Write(ws, binary.LittleEndian, s.Sequence)
 	binary.Write(ws, binary.LittleEndian, s.Originator)
@@ -106,30 +142,9 @@ func encodeTable(ws io.Writer, p *panda.Table) error {
 	binary.Write(ws, binary.LittleEndian, s.Auxiliary)
 	binary.Write(ws, binary.LittleEndian, s.Id)
 	ws.Write(s.Info[:])
-	ws.Write(body)
-
-	sum := digest.Sum32()
-	binary.Write(ws, binary.LittleEndian, sum)
-
-	return nil
 }
 
-func encodeImage(ws io.Writer, p *panda.Image) error {
-	body := p.Payload()
-	size := uint32(VMUHLen + SDHLenV2 + len(body) - 4)
-
-	binary.Write(ws, binary.BigEndian, uint32(HRDLMagic))
-	binary.Write(ws, binary.LittleEndian, size)
-
-	digest := SumHRDL()
-	ws = io.MultiWriter(ws, digest)
-	if err := encodeVMUHeader(ws, p.VMUHeader); err != nil {
-		return err
-	}
-	i, ok := p.IDH.(*panda.IDHv2)
-	if !ok {
-		return fmt.Errorf("invalid IDH version")
-	}
+func encodeIDH(ws io.Writer, i *panda.IDHv2) {
 	binary.Write(ws, binary.LittleEndian, i.Properties)
 	binary.Write(ws, binary.LittleEndian, i.Sequence)
 	binary.Write(ws, binary.LittleEndian, i.Originator)
@@ -143,10 +158,4 @@ func encodeImage(ws io.Writer, p *panda.Image) error {
 	binary.Write(ws, binary.LittleEndian, i.Scaling)
 	binary.Write(ws, binary.LittleEndian, i.Ratio)
 	ws.Write(i.Info[:])
-	ws.Write(body)
-
-	sum := digest.Sum32()
-	binary.Write(ws, binary.LittleEndian, sum)
-
-	return nil
 }